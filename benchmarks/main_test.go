@@ -25,6 +25,7 @@ import (
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
 	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/reflection"
 	"google.golang.org/protobuf/encoding/protojson"
 	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/types/known/emptypb"
@@ -234,6 +235,115 @@ func BenchmarkLarking(b *testing.B) {
 	})
 }
 
+// BenchmarkLarkingProxy compares proxying to a gRPC backend. Native gRPC
+// calls are forwarded as raw frames unless an interceptor requires the
+// messages to be decoded.
+func BenchmarkLarkingProxy(b *testing.B) {
+	noopInterceptor := func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		return handler(ctx, req)
+	}
+	b.Run("Passthrough", func(b *testing.B) {
+		benchLarkingProxy(b)
+	})
+	b.Run("Transcode", func(b *testing.B) {
+		benchLarkingProxy(b, larking.UnaryServerInterceptorOption(noopInterceptor))
+	})
+}
+
+func benchLarkingProxy(b *testing.B, opts ...larking.MuxOption) {
+	ctx := context.Background()
+	svc := &testService{}
+
+	gs := grpc.NewServer()
+	librarypb.RegisterLibraryServiceServer(gs, svc)
+	reflection.Register(gs)
+
+	lisBackend, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		b.Fatalf("failed to listen: %v", err)
+	}
+	defer lisBackend.Close()
+
+	var g errgroup.Group
+	defer func() {
+		if err := g.Wait(); err != nil {
+			b.Fatal(err)
+		}
+		b.Log("all server shutdown")
+	}()
+
+	g.Go(func() error {
+		return gs.Serve(lisBackend)
+	})
+	defer gs.Stop()
+
+	backend, err := grpc.Dial(
+		lisBackend.Addr().String(),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer backend.Close()
+
+	mux, err := larking.NewMux(opts...)
+	if err != nil {
+		b.Fatal(err)
+	}
+	if err := mux.RegisterConn(ctx, backend); err != nil {
+		b.Fatal(err)
+	}
+
+	ts, err := larking.NewServer(mux)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	lis, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		b.Fatalf("failed to listen: %v", err)
+	}
+	defer lis.Close()
+
+	g.Go(func() (err error) {
+		if err := ts.Serve(lis); err != nil && err != http.ErrServerClosed {
+			return err
+		}
+		return nil
+	})
+	defer func() {
+		b.Log("shutdown server")
+		if err := ts.Shutdown(ctx); err != nil {
+			b.Fatal(err)
+		}
+	}()
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	cc, err := grpc.DialContext(
+		ctx,
+		lis.Addr().String(),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithBlock(),
+	)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer func() {
+		if err := cc.Close(); err != nil {
+			b.Fatal(err)
+		}
+	}()
+	client := librarypb.NewLibraryServiceClient(cc)
+
+	b.Run("GRPC_GetBook", func(b *testing.B) {
+		benchGRPC_GetBook(b, client)
+	})
+	b.Run("HTTP_GetBook+pb", func(b *testing.B) {
+		benchHTTP_GetBook(b, lis.Addr().String(), true)
+	})
+}
+
 func BenchmarkGRPCGateway(b *testing.B) {
 	ctx := context.Background()
 	svc := &testService{}
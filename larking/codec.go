@@ -5,9 +5,12 @@
 package larking
 
 import (
+	"bytes"
 	"encoding/binary"
 	"fmt"
 	"io"
+	"sort"
+	"strconv"
 	"sync"
 
 	"google.golang.org/grpc/encoding"
@@ -15,6 +18,8 @@ import (
 	"google.golang.org/protobuf/encoding/protojson"
 	"google.golang.org/protobuf/encoding/protowire"
 	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/known/wrapperspb"
 )
 
 var bytesPool = sync.Pool{
@@ -251,6 +256,202 @@ func (c CodecJSON) WriteNext(w io.Writer, b []byte) (int, error) {
 
 func (CodecJSON) Name() string { return "json" }
 
+// CodecNDJSON is a StreamCodec for newline delimited JSON, one protobuf json
+// message per line. MarshalOptions must not set Multiline.
+type CodecNDJSON struct {
+	CodecJSON
+}
+
+// ReadNext reads the next line from r, blank lines are skipped.
+// A final line without a trailing newline is returned at EOF.
+func (c CodecNDJSON) ReadNext(b []byte, r io.Reader, limit int) ([]byte, int, error) {
+	for i := 0; ; i++ {
+		for i >= len(b) {
+			if limit > 0 && len(b) > limit {
+				return b, 0, &protodelim.SizeTooLargeError{Size: uint64(len(b)), MaxSize: uint64(limit)}
+			}
+			if len(b) == cap(b) {
+				// Add more capacity (let append pick how much).
+				b = append(b, 0)[:len(b)]
+			}
+			n, err := r.Read(b[len(b):cap(b)])
+			b = b[:len(b)+n]
+			if err == io.EOF && i < len(b) {
+				continue // scan the remaining bytes
+			}
+			if err == io.EOF && len(bytes.TrimSpace(b)) > 0 {
+				if limit > 0 && len(b) > limit {
+					return b, 0, &protodelim.SizeTooLargeError{Size: uint64(len(b)), MaxSize: uint64(limit)}
+				}
+				return b, len(b), nil
+			}
+			if err != nil {
+				return b, 0, err
+			}
+		}
+		if b[i] != '\n' {
+			continue
+		}
+		if limit > 0 && i > limit {
+			return b, 0, &protodelim.SizeTooLargeError{Size: uint64(i), MaxSize: uint64(limit)}
+		}
+		if len(bytes.TrimSpace(b[:i])) == 0 {
+			// Skip blank lines.
+			b = b[:copy(b, b[i+1:])]
+			i = -1
+			continue
+		}
+		return b, i + 1, nil
+	}
+}
+
+// WriteNext writes the JSON message to w followed by a newline.
+func (c CodecNDJSON) WriteNext(w io.Writer, b []byte) (int, error) {
+	n, err := w.Write(b)
+	if err != nil {
+		return n, err
+	}
+	m, err := w.Write([]byte{'\n'})
+	return n + m, err
+}
+
+func (CodecNDJSON) Name() string { return "ndjson" }
+
+// jsonMarshalOptions returns the protojson options of JSON codecs.
+func jsonMarshalOptions(c Codec) (protojson.MarshalOptions, bool) {
+	switch c := c.(type) {
+	case CodecJSON:
+		return c.MarshalOptions, true
+	case *CodecJSON:
+		return c.MarshalOptions, true
+	case CodecNDJSON:
+		return c.MarshalOptions, true
+	case *CodecNDJSON:
+		return c.MarshalOptions, true
+	}
+	return protojson.MarshalOptions{}, false
+}
+
+// marshalFieldAppend appends the encoding of the field value of msg, for
+// response bodies that aren't messages. JSON codecs encode the value, other
+// codecs encode msg with only the field set.
+func marshalFieldAppend(c Codec, b []byte, msg protoreflect.Message, fd protoreflect.FieldDescriptor) ([]byte, error) {
+	opts, ok := jsonMarshalOptions(c)
+	if !ok {
+		tmp := msg.Type().New()
+		if msg.Has(fd) {
+			tmp.Set(fd, msg.Get(fd))
+		}
+		return c.MarshalAppend(b, tmp.Interface())
+	}
+	if fd.HasPresence() && !msg.Has(fd) {
+		return append(b, "null"...), nil
+	}
+	return appendJSONValue(opts, b, fd, msg.Get(fd))
+}
+
+// appendJSONValue appends the protojson encoding of the field value.
+func appendJSONValue(opts protojson.MarshalOptions, b []byte, fd protoreflect.FieldDescriptor, v protoreflect.Value) ([]byte, error) {
+	var err error
+	switch {
+	case fd.IsList():
+		l := v.List()
+		b = append(b, '[')
+		for i := 0; i < l.Len(); i++ {
+			if i > 0 {
+				b = append(b, ',')
+			}
+			if b, err = appendJSONSingular(opts, b, fd, l.Get(i)); err != nil {
+				return nil, err
+			}
+		}
+		return append(b, ']'), nil
+	case fd.IsMap():
+		m := v.Map()
+		keys := make([]protoreflect.MapKey, 0, m.Len())
+		m.Range(func(k protoreflect.MapKey, _ protoreflect.Value) bool {
+			keys = append(keys, k)
+			return true
+		})
+		sortMapKeys(fd.MapKey().Kind(), keys)
+		b = append(b, '{')
+		for i, k := range keys {
+			if i > 0 {
+				b = append(b, ',')
+			}
+			if b, err = opts.MarshalAppend(b, wrapperspb.String(k.String())); err != nil {
+				return nil, err
+			}
+			b = append(b, ':')
+			if b, err = appendJSONSingular(opts, b, fd.MapValue(), m.Get(k)); err != nil {
+				return nil, err
+			}
+		}
+		return append(b, '}'), nil
+	default:
+		return appendJSONSingular(opts, b, fd, v)
+	}
+}
+
+// appendJSONSingular appends the protojson encoding of a singular value.
+// Scalars are encoded as their wrapper types.
+func appendJSONSingular(opts protojson.MarshalOptions, b []byte, fd protoreflect.FieldDescriptor, v protoreflect.Value) ([]byte, error) {
+	var m proto.Message
+	switch fd.Kind() {
+	case protoreflect.MessageKind, protoreflect.GroupKind:
+		m = v.Message().Interface()
+	case protoreflect.EnumKind:
+		if fd.Enum().FullName() == "google.protobuf.NullValue" {
+			return append(b, "null"...), nil
+		}
+		n := v.Enum()
+		if ev := fd.Enum().Values().ByNumber(n); ev != nil && !opts.UseEnumNumbers {
+			m = wrapperspb.String(string(ev.Name()))
+		} else {
+			return strconv.AppendInt(b, int64(n), 10), nil
+		}
+	case protoreflect.BoolKind:
+		m = wrapperspb.Bool(v.Bool())
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind:
+		m = wrapperspb.Int32(int32(v.Int()))
+	case protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind:
+		m = wrapperspb.Int64(v.Int())
+	case protoreflect.Uint32Kind, protoreflect.Fixed32Kind:
+		m = wrapperspb.UInt32(uint32(v.Uint()))
+	case protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		m = wrapperspb.UInt64(v.Uint())
+	case protoreflect.FloatKind:
+		m = wrapperspb.Float(float32(v.Float()))
+	case protoreflect.DoubleKind:
+		m = wrapperspb.Double(v.Float())
+	case protoreflect.StringKind:
+		m = wrapperspb.String(v.String())
+	case protoreflect.BytesKind:
+		m = wrapperspb.Bytes(v.Bytes())
+	default:
+		return nil, fmt.Errorf("unsupported field kind %v", fd.Kind())
+	}
+	return opts.MarshalAppend(b, m)
+}
+
+// sortMapKeys sorts the keys in protojson order.
+func sortMapKeys(kind protoreflect.Kind, keys []protoreflect.MapKey) {
+	sort.Slice(keys, func(i, j int) bool {
+		switch kind {
+		case protoreflect.BoolKind:
+			return !keys[i].Bool() && keys[j].Bool()
+		case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind,
+			protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind:
+			return keys[i].Int() < keys[j].Int()
+		case protoreflect.Uint32Kind, protoreflect.Fixed32Kind,
+			protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+			return keys[i].Uint() < keys[j].Uint()
+		default:
+			return keys[i].String() < keys[j].String()
+		}
+	})
+}
+
 type codecHTTPBody struct{}
 
 func (codecHTTPBody) Marshal(v interface{}) ([]byte, error) {
@@ -289,3 +490,59 @@ func (codecHTTPBody) ReadNext(b []byte, r io.Reader, limit int) ([]byte, int, er
 func (codecHTTPBody) WriteNext(w io.Writer, b []byte) (int, error) {
 	return w.Write(b)
 }
+
+// frame is a protobuf encoded message forwarded without decoding. The bytes
+// are kept as on the wire, compressed by comp if set.
+type frame struct {
+	b    []byte
+	comp Compressor
+}
+
+// bytes returns the uncompressed message.
+func (f *frame) bytes() ([]byte, error) {
+	if f.comp == nil {
+		return f.b, nil
+	}
+	r, err := f.comp.Decompress(bytes.NewReader(f.b))
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+// codecFrame passes frames through as is. Named "proto" to match the wire
+// format of the upstream server. Compressed frames are decompressed, gRPC
+// clients compress messages themselves.
+type codecFrame struct{}
+
+func (codecFrame) Marshal(v interface{}) ([]byte, error) {
+	f, ok := v.(*frame)
+	if !ok {
+		return nil, errInvalidType(v)
+	}
+	return f.bytes()
+}
+
+func (codecFrame) MarshalAppend(b []byte, v interface{}) ([]byte, error) {
+	f, ok := v.(*frame)
+	if !ok {
+		return nil, errInvalidType(v)
+	}
+	fb, err := f.bytes()
+	if err != nil {
+		return nil, err
+	}
+	return append(b, fb...), nil
+}
+
+func (codecFrame) Unmarshal(data []byte, v interface{}) error {
+	f, ok := v.(*frame)
+	if !ok {
+		return errInvalidType(v)
+	}
+	f.b = append(f.b[:0], data...)
+	f.comp = nil
+	return nil
+}
+
+func (codecFrame) Name() string { return "proto" }
@@ -2,11 +2,20 @@ package larking
 
 import (
 	"bytes"
+	"encoding/json"
 	"errors"
+	"io"
+	"math"
+	"slices"
 	"testing"
 
+	"github.com/google/go-cmp/cmp"
+	"google.golang.org/protobuf/encoding/protodelim"
+	"google.golang.org/protobuf/encoding/protojson"
 	"google.golang.org/protobuf/encoding/protowire"
 	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/testing/protocmp"
+	"google.golang.org/protobuf/types/known/structpb"
 	"larking.io/api/testpb"
 )
 
@@ -31,6 +40,7 @@ func TestStreamCodecs(t *testing.T) {
 		t.Fatal(err)
 	}
 	jsonescape := []byte(`{"text":"hello, json} \" }}"}`)
+	ndjsonb := append(append([]byte(nil), jsonb...), '\n')
 
 	tests := []struct {
 		name    string
@@ -119,6 +129,23 @@ func TestStreamCodecs(t *testing.T) {
 		codec: CodecJSON{},
 		input: jsonescape,
 		want:  jsonescape,
+	}, {
+		name:  "ndjson buffered",
+		codec: CodecNDJSON{},
+		input: ndjsonb,
+		want:  ndjsonb,
+	}, {
+		name:  "ndjson unbuffered",
+		codec: CodecNDJSON{},
+		input: make([]byte, 0, 4+len(ndjsonb)),
+		extra: ndjsonb,
+		want:  ndjsonb,
+	}, {
+		name:  "ndjson partial line",
+		codec: CodecNDJSON{},
+		input: ndjsonb[:2],
+		extra: ndjsonb[2:],
+		want:  ndjsonb,
 	}}
 
 	for _, tt := range tests {
@@ -168,3 +195,129 @@ func TestStreamCodecs(t *testing.T) {
 		})
 	}
 }
+
+func TestCodecNDJSONLines(t *testing.T) {
+	codec := CodecNDJSON{}
+	r := bytes.NewReader([]byte("{\"text\":\"one\"}\r\n\n  \n{\"text\":\"two\"}\n{\"text\":\"three\"}"))
+
+	var (
+		b    []byte
+		got  []string
+		last error
+	)
+	for {
+		var n int
+		b, n, last = codec.ReadNext(b, r, 64)
+		if last != nil {
+			break
+		}
+		var msg testpb.Message
+		if err := codec.Unmarshal(b[:n], &msg); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, msg.Text)
+		b = b[:copy(b, b[n:])]
+	}
+	if last != io.EOF {
+		t.Fatalf("got %v, want EOF", last)
+	}
+	if want := []string{"one", "two", "three"}; !slices.Equal(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+
+	_, _, err := codec.ReadNext(nil, bytes.NewReader([]byte("{\"text\":\"too long\"}\n")), 8)
+	var sizeErr *protodelim.SizeTooLargeError
+	if !errors.As(err, &sizeErr) {
+		t.Fatalf("got %v, want size error", err)
+	}
+}
+
+func TestMarshalFieldAppend(t *testing.T) {
+	msg := &testpb.ComplexRequest{
+		DoubleValue:   1.5e-7,
+		FloatValue:    float32(math.Inf(1)),
+		Int32Value:    -32,
+		Int64Value:    -64,
+		Uint32Value:   32,
+		Uint64Value:   math.MaxUint64,
+		Fixed64Value:  64,
+		Sfixed64Value: -64,
+		BoolValue:     true,
+		StringValue:   "<a href=\"\u2028\">\n</a>",
+		BytesValue:    []byte{0xff, 0x00},
+		DoubleList:    []float64{math.NaN(), 1e21, -0.5},
+		Int64List:     []int64{1, -2},
+		BoolList:      []bool{true, false},
+		BytesList:     [][]byte{[]byte("a"), nil},
+		DoubleMap:     map[string]float64{"b": 1, "a": 2},
+		Int32Map:      map[int32]int32{10: 1, -2: 2, 3: 3},
+		Uint64Map:     map[uint64]uint64{math.MaxUint64: 1, 2: 2},
+		BoolMap:       map[bool]bool{true: false, false: true},
+		BytesMap:      map[string][]byte{"k": []byte("v")},
+		NullValue:     structpb.NullValue_NULL_VALUE,
+		NestedList:    []*testpb.ComplexRequest_Nested{{}, {}},
+		NestedMap:     map[string]*testpb.ComplexRequest_Nested{"n": {}},
+		EnumValue:     testpb.ComplexRequest_ENUM_VALUE,
+		EnumList:      []testpb.ComplexRequest_Enum{1, 0, 7},
+		EnumMap:       map[string]testpb.ComplexRequest_Enum{"e": 1},
+	}
+	m := msg.ProtoReflect()
+
+	for _, opts := range []protojson.MarshalOptions{
+		{},
+		{UseEnumNumbers: true, UseProtoNames: true},
+	} {
+		// Reference encoding of the fields, unpopulated fields are
+		// emitted unless they have presence.
+		fields := make(map[string]interface{})
+		for _, emit := range []bool{true, false} {
+			o := opts
+			o.EmitUnpopulated = emit
+			raw, err := o.Marshal(msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := json.Unmarshal(raw, &fields); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		fds := m.Descriptor().Fields()
+		for i := 0; i < fds.Len(); i++ {
+			fd := fds.Get(i)
+			if fd.Message() != nil && !fd.IsList() && !fd.IsMap() {
+				continue // messages are response bodies
+			}
+			name := fd.JSONName()
+			if opts.UseProtoNames {
+				name = string(fd.Name())
+			}
+			b, err := marshalFieldAppend(CodecJSON{MarshalOptions: opts}, nil, m, fd)
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			var got interface{}
+			if err := json.Unmarshal(b, &got); err != nil {
+				t.Fatalf("%s: %v: %s", name, err, b)
+			}
+			if diff := cmp.Diff(fields[name], got); diff != "" {
+				t.Errorf("%s: %s", name, diff)
+			}
+		}
+	}
+
+	// Proto codecs encode the message with only the field set.
+	fd := m.Descriptor().Fields().ByName("int64_list")
+	b, err := marshalFieldAppend(CodecProto{}, nil, m, fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := &testpb.ComplexRequest{}
+	if err := proto.Unmarshal(b, got); err != nil {
+		t.Fatal(err)
+	}
+	want := &testpb.ComplexRequest{Int64List: msg.Int64List}
+	if diff := cmp.Diff(want, got, protocmp.Transform()); diff != "" {
+		t.Fatal(diff)
+	}
+}
@@ -0,0 +1,449 @@
+// Copyright 2024 Edward McFarlane. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package larking
+
+// Support for the Connect protocol
+// https://connectrpc.com/docs/protocol
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	spb "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+const (
+	connectStreamPrefix    = "application/connect+"
+	connectProtocolVersion = "1"
+	connectFlagCompressed  = 0x01
+	connectFlagEndStream   = 0x02
+)
+
+// isConnectRequest checks for Connect requests, returning the codec name.
+// Unary POST requests must set the Connect-Protocol-Version header, GET
+// requests the connect=v1 query param. GET requests are only served for
+// methods without side effects, see connectGetAllowed.
+func isConnectRequest(r *http.Request) (enc string, stream bool, ok bool) {
+	ct := r.Header.Get("Content-Type")
+	switch r.Method {
+	case http.MethodPost:
+		if enc, ok := strings.CutPrefix(ct, connectStreamPrefix); ok {
+			return enc, true, true
+		}
+		if r.Header.Get("Connect-Protocol-Version") != connectProtocolVersion {
+			return "", false, false
+		}
+		enc, ok := strings.CutPrefix(ct, "application/")
+		return enc, false, ok
+	case http.MethodGet:
+		q := r.URL.Query()
+		if q.Get("connect") != "v"+connectProtocolVersion {
+			return "", false, false
+		}
+		return q.Get("encoding"), false, true
+	default:
+		return "", false, false
+	}
+}
+
+// connectErrorDetail is an error detail, with the value base64 encoded.
+type connectErrorDetail struct {
+	Type  string          `json:"type"`
+	Value string          `json:"value"`
+	Debug json.RawMessage `json:"debug,omitempty"`
+}
+
+type connectError struct {
+	Code    string                `json:"code"`
+	Message string                `json:"message,omitempty"`
+	Details []*connectErrorDetail `json:"details,omitempty"`
+}
+
+type connectEndStream struct {
+	Error    *connectError       `json:"error,omitempty"`
+	Metadata map[string][]string `json:"metadata,omitempty"`
+}
+
+// connectCodes maps gRPC codes to Connect error codes.
+// https://connectrpc.com/docs/protocol#error-codes
+var connectCodes = [...]string{
+	"",                    // 0
+	"canceled",            // 1
+	"unknown",             // 2
+	"invalid_argument",    // 3
+	"deadline_exceeded",   // 4
+	"not_found",           // 5
+	"already_exists",      // 6
+	"permission_denied",   // 7
+	"resource_exhausted",  // 8
+	"failed_precondition", // 9
+	"aborted",             // 10
+	"out_of_range",        // 11
+	"unimplemented",       // 12
+	"internal",            // 13
+	"unavailable",         // 14
+	"data_loss",           // 15
+	"unauthenticated",     // 16
+}
+
+// connectCode returns the Connect error code of the gRPC code.
+func connectCode(c codes.Code) string {
+	if int(c) >= len(connectCodes) || c == codes.OK {
+		return "unknown"
+	}
+	return connectCodes[c]
+}
+
+// newConnectError returns the Connect error of the status.
+func newConnectError(st *spb.Status) *connectError {
+	cerr := &connectError{
+		Code:    connectCode(codes.Code(st.GetCode())),
+		Message: st.GetMessage(),
+	}
+	for _, detail := range st.GetDetails() {
+		d := &connectErrorDetail{
+			Type:  strings.TrimPrefix(detail.GetTypeUrl(), "type.googleapis.com/"),
+			Value: base64.RawStdEncoding.EncodeToString(detail.GetValue()),
+		}
+		if msg, err := detail.UnmarshalNew(); err == nil {
+			if b, err := protojson.Marshal(msg); err == nil {
+				d.Debug = b
+			}
+		}
+		cerr.Details = append(cerr.Details, d)
+	}
+	return cerr
+}
+
+// connectHTTPCode maps HTTP errors written before the gRPC response to codes.
+func connectHTTPCode(statusCode int) codes.Code {
+	switch statusCode {
+	case http.StatusBadRequest:
+		return codes.Internal
+	case http.StatusUnauthorized:
+		return codes.Unauthenticated
+	case http.StatusForbidden:
+		return codes.PermissionDenied
+	case http.StatusNotFound:
+		return codes.Unimplemented
+	case http.StatusTooManyRequests, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return codes.Unavailable
+	default:
+		return codes.Unknown
+	}
+}
+
+// connectWriter translates gRPC responses to Connect responses.
+// Unary responses are buffered, streams are written as envelopes.
+type connectWriter struct {
+	w           http.ResponseWriter
+	header      http.Header
+	seenHeaders map[string]bool
+	enc         string
+	stream      bool
+	wroteHeader bool
+
+	errCode int          // HTTP error written by the gRPC handler
+	buf     bytes.Buffer // unary response or HTTP error
+}
+
+func (w *connectWriter) Header() http.Header { return w.header }
+
+func (w *connectWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	keys := make(map[string]bool, len(w.header))
+	for k := range w.header {
+		keys[k] = true
+	}
+	w.seenHeaders = keys
+	if code != http.StatusOK {
+		w.errCode = code
+		return
+	}
+	if !w.stream {
+		return
+	}
+
+	// Stream headers.
+	h := w.w.Header()
+	for k, vs := range w.header {
+		if k == "Trailer" || k == "Content-Type" || strings.HasPrefix(k, "Grpc-") {
+			continue
+		}
+		h[k] = vs
+	}
+	h.Set("Content-Type", connectStreamPrefix+w.enc)
+	if e := w.header.Get("Grpc-Encoding"); e != "" {
+		h.Set("Connect-Content-Encoding", e)
+	}
+	w.w.WriteHeader(http.StatusOK)
+}
+
+func (w *connectWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.stream || w.errCode != 0 {
+		return w.buf.Write(b)
+	}
+	return w.w.Write(b)
+}
+
+func (w *connectWriter) Flush() {
+	if w.stream && w.wroteHeader && w.errCode == 0 {
+		if f, ok := w.w.(http.Flusher); ok {
+			f.Flush()
+		}
+	}
+}
+
+// status returns the gRPC status of the response.
+func (w *connectWriter) status() *spb.Status {
+	if w.errCode != 0 {
+		return &spb.Status{
+			Code:    int32(connectHTTPCode(w.errCode)),
+			Message: strings.TrimSpace(w.buf.String()),
+		}
+	}
+	h := w.header
+	st := &spb.Status{Code: int32(codes.Unknown)}
+	if v, err := strconv.Atoi(h.Get("Grpc-Status")); err == nil {
+		st.Code = int32(v)
+	} else {
+		st.Message = "missing gRPC status"
+		return st
+	}
+	if msg, err := url.PathUnescape(h.Get("Grpc-Message")); err == nil {
+		st.Message = msg
+	} else {
+		st.Message = h.Get("Grpc-Message")
+	}
+	if v := h.Get("Grpc-Status-Details-Bin"); v != "" {
+		if b, err := decodeBinHeader(v); err == nil {
+			details := &spb.Status{}
+			if err := proto.Unmarshal([]byte(b), details); err == nil {
+				st.Details = details.Details
+			}
+		}
+	}
+	return st
+}
+
+// trailers returns the metadata set after the headers were written.
+func (w *connectWriter) trailers() map[string][]string {
+	md := make(map[string][]string)
+	for k, vs := range w.header {
+		if w.seenHeaders[k] || k == "Trailer" || strings.HasPrefix(k, "Grpc-") {
+			continue
+		}
+		md[strings.ToLower(strings.TrimPrefix(k, http.TrailerPrefix))] = vs
+	}
+	return md
+}
+
+// finishStream writes the end of stream message.
+func (w *connectWriter) finishStream() {
+	if !w.wroteHeader || w.errCode != 0 {
+		h := w.w.Header()
+		h.Set("Content-Type", connectStreamPrefix+w.enc)
+		w.w.WriteHeader(http.StatusOK)
+	}
+
+	end := connectEndStream{}
+	if st := w.status(); st.GetCode() != int32(codes.OK) {
+		end.Error = newConnectError(st)
+	}
+	if md := w.trailers(); len(md) > 0 {
+		end.Metadata = md
+	}
+	b, err := json.Marshal(end)
+	if err != nil {
+		return // nothing
+	}
+
+	head := []byte{connectFlagEndStream, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(head[1:5], uint32(len(b)))
+	w.w.Write(head) //nolint
+	w.w.Write(b)    //nolint
+	if f, ok := w.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// finishUnary writes the buffered unary response.
+func (w *connectWriter) finishUnary() {
+	h := w.w.Header()
+	st := w.status()
+	for k, vs := range w.header {
+		if k == "Trailer" || k == "Content-Type" || strings.HasPrefix(k, "Grpc-") {
+			continue
+		}
+		if w.seenHeaders[k] {
+			h[k] = vs
+		} else {
+			h[http.CanonicalHeaderKey("Trailer-"+k)] = vs
+		}
+	}
+
+	if st.GetCode() != int32(codes.OK) {
+		writeConnectError(w.w, st)
+		return
+	}
+
+	// Unwrap the message frame.
+	b := w.buf.Bytes()
+	if len(b) < 5 || len(b)-5 < int(binary.BigEndian.Uint32(b[1:5])) {
+		writeConnectError(w.w, &spb.Status{
+			Code:    int32(codes.Internal),
+			Message: "invalid gRPC response message",
+		})
+		return
+	}
+	if b[0]&connectFlagCompressed != 0 {
+		h.Set("Content-Encoding", w.header.Get("Grpc-Encoding"))
+	}
+	h.Set("Content-Type", "application/"+w.enc)
+	w.w.WriteHeader(http.StatusOK)
+	w.w.Write(b[5 : 5+binary.BigEndian.Uint32(b[1:5])]) //nolint
+}
+
+func writeConnectError(w http.ResponseWriter, st *spb.Status) {
+	b, err := json.Marshal(newConnectError(st))
+	if err != nil {
+		panic(err) // ...
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(HTTPStatusCode(codes.Code(st.GetCode())))
+	w.Write(b) //nolint
+}
+
+// connectGetAllowed reports whether the method can be called with a GET
+// request, only methods with the idempotency_level NO_SIDE_EFFECTS.
+// Unknown methods are left to report unimplemented.
+func (m *Mux) connectGetAllowed(name string) bool {
+	s := m.loadState()
+	if s == nil || len(s.handlers[name]) == 0 {
+		return true
+	}
+	opts, ok := s.handlers[name][0].desc.Options().(*descriptorpb.MethodOptions)
+	return ok && opts.GetIdempotencyLevel() == descriptorpb.MethodOptions_NO_SIDE_EFFECTS
+}
+
+// serveConnect serves Connect requests by translating them to gRPC.
+func (m *Mux) serveConnect(w http.ResponseWriter, r *http.Request, enc string, stream bool) {
+	if r.Method == http.MethodGet && !m.connectGetAllowed(r.URL.Path) {
+		w.Header().Set("Allow", http.MethodPost)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	hdr := r.Header.Clone()
+	hdr.Del("Content-Length")
+	hdr.Del("Connect-Protocol-Version")
+	hdr.Set("Content-Type", grpcBase+"+"+enc)
+	if v := hdr.Get("Connect-Timeout-Ms"); v != "" {
+		hdr.Del("Connect-Timeout-Ms")
+		if _, err := strconv.ParseUint(v, 10, 64); err != nil || len(v) > 8 {
+			writeConnectError(w, &spb.Status{
+				Code:    int32(codes.InvalidArgument),
+				Message: fmt.Sprintf("invalid timeout %q", v),
+			})
+			return
+		}
+		hdr.Set("Grpc-Timeout", v+"m")
+	}
+
+	var body io.ReadCloser = r.Body
+	if stream {
+		hdr.Del("Content-Encoding")
+		if e := hdr.Get("Connect-Content-Encoding"); e != "" {
+			hdr.Del("Connect-Content-Encoding")
+			hdr.Set("Grpc-Encoding", e)
+		}
+	} else {
+		b, compression, err := m.readConnectUnary(r)
+		if err != nil {
+			writeConnectError(w, &spb.Status{
+				Code:    int32(codes.InvalidArgument),
+				Message: err.Error(),
+			})
+			return
+		}
+		hdr.Del("Content-Encoding")
+		hdr.Del("Accept-Encoding")
+
+		// Frame as a gRPC message.
+		head := []byte{0, 0, 0, 0, 0}
+		if compression != "" && compression != "identity" {
+			head[0] = 1
+			hdr.Set("Grpc-Encoding", compression)
+		}
+		binary.BigEndian.PutUint32(head[1:5], uint32(len(b)))
+		body = io.NopCloser(io.MultiReader(
+			bytes.NewReader(head), bytes.NewReader(b),
+		))
+	}
+
+	r = r.Clone(r.Context())
+	r.Method = http.MethodPost
+	r.ProtoMajor = 2
+	r.ProtoMinor = 0
+	r.Header = hdr
+	r.Body = body
+
+	cw := &connectWriter{
+		w:      w,
+		header: make(http.Header),
+		enc:    enc,
+		stream: stream,
+	}
+	m.serveGRPC(cw, r)
+	if stream {
+		cw.finishStream()
+	} else {
+		cw.finishUnary()
+	}
+}
+
+// readConnectUnary reads the unary request message and its compression.
+func (m *Mux) readConnectUnary(r *http.Request) ([]byte, string, error) {
+	if r.Method == http.MethodPost {
+		b, err := m.opts.readAll(nil, r.Body)
+		if err != nil && err != io.EOF {
+			return nil, "", err
+		}
+		return b, r.Header.Get("Content-Encoding"), nil
+	}
+
+	q := r.URL.Query()
+	msg := q.Get("message")
+	if q.Get("base64") == "1" {
+		enc := base64.URLEncoding
+		if len(msg)%4 != 0 {
+			enc = enc.WithPadding(base64.NoPadding)
+		}
+		b, err := enc.DecodeString(msg)
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid base64 message: %w", err)
+		}
+		return b, q.Get("compression"), nil
+	}
+	return []byte(msg), q.Get("compression"), nil
+}
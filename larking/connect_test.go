@@ -0,0 +1,409 @@
+// Copyright 2024 Edward McFarlane. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package larking
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	grpc_testing "google.golang.org/grpc/interop/grpc_testing"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/testing/protocmp"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+type connectServer struct {
+	responseBodyServer
+}
+
+func (s *connectServer) UnaryCall(ctx context.Context, req *grpc_testing.SimpleRequest) (*grpc_testing.SimpleResponse, error) {
+	if err := grpc.SetHeader(ctx, metadata.Pairs("x-header", "header")); err != nil {
+		return nil, err
+	}
+	if err := grpc.SetTrailer(ctx, metadata.Pairs("x-trailer", "trailer")); err != nil {
+		return nil, err
+	}
+	if rs := req.ResponseStatus; rs != nil {
+		st, err := status.New(codes.Code(rs.Code), rs.Message).WithDetails(
+			&errdetails.ErrorInfo{Reason: "REASON", Domain: "larking.io"},
+		)
+		if err != nil {
+			return nil, err
+		}
+		return nil, st.Err()
+	}
+	return s.responseBodyServer.UnaryCall(ctx, req)
+}
+
+func (s *connectServer) StreamingOutputCall(req *grpc_testing.StreamingOutputCallRequest, stream grpc_testing.TestService_StreamingOutputCallServer) error {
+	if rs := req.ResponseStatus; rs != nil {
+		return status.Error(codes.Code(rs.Code), rs.Message)
+	}
+	stream.SetTrailer(metadata.Pairs("x-trailer", "trailer"))
+	return s.responseBodyServer.StreamingOutputCall(req, stream)
+}
+
+// noSideEffectsFiles returns the test service files with UnaryCall marked
+// idempotency_level NO_SIDE_EFFECTS, allowing Connect GET requests.
+func noSideEffectsFiles(t *testing.T) *protoregistry.Files {
+	t.Helper()
+	fdp := protodesc.ToFileDescriptorProto(grpc_testing.File_grpc_testing_test_proto)
+	for _, sd := range fdp.Service {
+		for _, md := range sd.Method {
+			if md.GetName() == "UnaryCall" {
+				md.Options = &descriptorpb.MethodOptions{
+					IdempotencyLevel: descriptorpb.MethodOptions_NO_SIDE_EFFECTS.Enum(),
+				}
+			}
+		}
+	}
+	fd, err := protodesc.NewFile(fdp, protoregistry.GlobalFiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := new(protoregistry.Files)
+	if err := files.RegisterFile(fd); err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestConnect(t *testing.T) {
+	m, err := NewMux(FilesOption(noSideEffectsFiles(t)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	grpc_testing.RegisterTestServiceServer(m, &connectServer{})
+
+	const (
+		unaryPath  = "/grpc.testing.TestService/UnaryCall"
+		streamPath = "/grpc.testing.TestService/StreamingOutputCall"
+	)
+	marshalJSON := func(msg proto.Message) []byte {
+		b, err := protojson.Marshal(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	marshalProto := func(msg proto.Message) []byte {
+		b, err := proto.Marshal(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	envelope := func(flags byte, b []byte) []byte {
+		head := []byte{flags, 0, 0, 0, 0}
+		binary.BigEndian.PutUint32(head[1:5], uint32(len(b)))
+		return append(head, b...)
+	}
+	serve := func(r *http.Request) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		m.ServeHTTP(w, r)
+		return w
+	}
+	opts := cmp.Options{protocmp.Transform()}
+
+	req := &grpc_testing.SimpleRequest{
+		Payload: &grpc_testing.Payload{Body: []byte("hi")},
+	}
+	want := &grpc_testing.SimpleResponse{
+		Payload:  &grpc_testing.Payload{Body: []byte("hi")},
+		Username: "larking",
+	}
+
+	t.Run("unaryJSON", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodPost, unaryPath, bytes.NewReader(marshalJSON(req)))
+		r.Header.Set("Content-Type", "application/json")
+		r.Header.Set("Connect-Protocol-Version", "1")
+		w := serve(r)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("got status %d: %s", w.Code, w.Body.String())
+		}
+		if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+			t.Fatalf("got content type %q", ct)
+		}
+		if h := w.Header().Get("X-Header"); h != "header" {
+			t.Errorf("got header %q", h)
+		}
+		if h := w.Header().Get("Trailer-X-Trailer"); h != "trailer" {
+			t.Errorf("got trailer %q", h)
+		}
+		got := &grpc_testing.SimpleResponse{}
+		if err := protojson.Unmarshal(w.Body.Bytes(), got); err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(want, got, opts...); diff != "" {
+			t.Fatal(diff)
+		}
+	})
+	t.Run("unaryProtoGzip", func(t *testing.T) {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Write(marshalProto(req)) //nolint
+		zw.Close()
+
+		r := httptest.NewRequest(http.MethodPost, unaryPath, &buf)
+		r.Header.Set("Content-Type", "application/proto")
+		r.Header.Set("Content-Encoding", "gzip")
+		r.Header.Set("Connect-Protocol-Version", "1")
+		w := serve(r)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("got status %d: %s", w.Code, w.Body.String())
+		}
+		if ce := w.Header().Get("Content-Encoding"); ce != "gzip" {
+			t.Fatalf("got content encoding %q", ce)
+		}
+		zr, err := gzip.NewReader(w.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := io.ReadAll(zr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := &grpc_testing.SimpleResponse{}
+		if err := proto.Unmarshal(b, got); err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(want, got, opts...); diff != "" {
+			t.Fatal(diff)
+		}
+	})
+	t.Run("unaryGet", func(t *testing.T) {
+		for _, q := range []url.Values{{
+			"connect":  {"v1"},
+			"encoding": {"json"},
+			"message":  {string(marshalJSON(req))},
+		}, {
+			"connect":  {"v1"},
+			"encoding": {"proto"},
+			"base64":   {"1"},
+			"message":  {base64.RawURLEncoding.EncodeToString(marshalProto(req))},
+		}} {
+			r := httptest.NewRequest(http.MethodGet, unaryPath+"?"+q.Encode(), nil)
+			w := serve(r)
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("got status %d: %s", w.Code, w.Body.String())
+			}
+			got := &grpc_testing.SimpleResponse{}
+			var err error
+			if q.Get("encoding") == "json" {
+				err = protojson.Unmarshal(w.Body.Bytes(), got)
+			} else {
+				err = proto.Unmarshal(w.Body.Bytes(), got)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(want, got, opts...); diff != "" {
+				t.Fatal(diff)
+			}
+		}
+	})
+	t.Run("unaryGetSideEffects", func(t *testing.T) {
+		m, err := NewMux()
+		if err != nil {
+			t.Fatal(err)
+		}
+		grpc_testing.RegisterTestServiceServer(m, &connectServer{})
+
+		q := url.Values{
+			"connect":  {"v1"},
+			"encoding": {"json"},
+			"message":  {string(marshalJSON(req))},
+		}
+		r := httptest.NewRequest(http.MethodGet, unaryPath+"?"+q.Encode(), nil)
+		w := httptest.NewRecorder()
+		m.ServeHTTP(w, r)
+
+		if w.Code != http.StatusMethodNotAllowed {
+			t.Fatalf("got status %d: %s", w.Code, w.Body.String())
+		}
+		if got := w.Header().Get("Allow"); got != http.MethodPost {
+			t.Fatalf("got Allow %q", got)
+		}
+	})
+	t.Run("unaryError", func(t *testing.T) {
+		req := &grpc_testing.SimpleRequest{
+			ResponseStatus: &grpc_testing.EchoStatus{
+				Code:    int32(codes.FailedPrecondition),
+				Message: "bad state",
+			},
+		}
+		r := httptest.NewRequest(http.MethodPost, unaryPath, bytes.NewReader(marshalJSON(req)))
+		r.Header.Set("Content-Type", "application/json")
+		r.Header.Set("Connect-Protocol-Version", "1")
+		w := serve(r)
+
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("got status %d: %s", w.Code, w.Body.String())
+		}
+		var got connectError
+		if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+			t.Fatal(err)
+		}
+		if got.Code != "failed_precondition" || got.Message != "bad state" {
+			t.Fatalf("unexpected error %+v", got)
+		}
+		if len(got.Details) != 1 || got.Details[0].Type != "google.rpc.ErrorInfo" {
+			t.Fatalf("unexpected details %s", w.Body.String())
+		}
+		b, err := base64.RawStdEncoding.DecodeString(got.Details[0].Value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		info := &errdetails.ErrorInfo{}
+		if err := proto.Unmarshal(b, info); err != nil {
+			t.Fatal(err)
+		}
+		if info.Reason != "REASON" {
+			t.Fatalf("got reason %q", info.Reason)
+		}
+	})
+	t.Run("unaryCanceled", func(t *testing.T) {
+		req := &grpc_testing.SimpleRequest{
+			ResponseStatus: &grpc_testing.EchoStatus{
+				Code:    int32(codes.Canceled),
+				Message: "canceled",
+			},
+		}
+		r := httptest.NewRequest(http.MethodPost, unaryPath, bytes.NewReader(marshalJSON(req)))
+		r.Header.Set("Content-Type", "application/json")
+		r.Header.Set("Connect-Protocol-Version", "1")
+		w := serve(r)
+
+		var got connectError
+		if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+			t.Fatal(err)
+		}
+		if got.Code != "canceled" {
+			t.Fatalf("got code %q", got.Code)
+		}
+	})
+	t.Run("unaryUnimplemented", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodPost, "/grpc.testing.TestService/Missing", strings.NewReader("{}"))
+		r.Header.Set("Content-Type", "application/json")
+		r.Header.Set("Connect-Protocol-Version", "1")
+		w := serve(r)
+
+		if w.Code != http.StatusNotImplemented {
+			t.Fatalf("got status %d: %s", w.Code, w.Body.String())
+		}
+		if !strings.Contains(w.Body.String(), `"code":"unimplemented"`) {
+			t.Fatalf("unexpected body %s", w.Body.String())
+		}
+	})
+
+	readStream := func(t *testing.T, body []byte) ([][]byte, connectEndStream) {
+		t.Helper()
+		var (
+			msgs [][]byte
+			end  connectEndStream
+		)
+		for len(body) > 0 {
+			if len(body) < 5 {
+				t.Fatalf("invalid envelope %X", body)
+			}
+			n := int(binary.BigEndian.Uint32(body[1:5]))
+			flags, b := body[0], body[5:5+n]
+			body = body[5+n:]
+			if flags&connectFlagEndStream != 0 {
+				if err := json.Unmarshal(b, &end); err != nil {
+					t.Fatal(err)
+				}
+				if len(body) != 0 {
+					t.Fatal("data after end of stream")
+				}
+				return msgs, end
+			}
+			msgs = append(msgs, b)
+		}
+		t.Fatal("missing end of stream")
+		return nil, end
+	}
+
+	t.Run("stream", func(t *testing.T) {
+		req := &grpc_testing.StreamingOutputCallRequest{
+			ResponseParameters: []*grpc_testing.ResponseParameters{
+				{Size: 1}, {Size: 2},
+			},
+		}
+		r := httptest.NewRequest(http.MethodPost, streamPath, bytes.NewReader(envelope(0, marshalJSON(req))))
+		r.Header.Set("Content-Type", "application/connect+json")
+		w := serve(r)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("got status %d: %s", w.Code, w.Body.String())
+		}
+		if ct := w.Header().Get("Content-Type"); ct != "application/connect+json" {
+			t.Fatalf("got content type %q", ct)
+		}
+		msgs, end := readStream(t, w.Body.Bytes())
+		if end.Error != nil {
+			t.Fatalf("unexpected error %+v", end.Error)
+		}
+		if got := end.Metadata["x-trailer"]; len(got) != 1 || got[0] != "trailer" {
+			t.Fatalf("unexpected metadata %v", end.Metadata)
+		}
+		if len(msgs) != 2 {
+			t.Fatalf("got %d messages", len(msgs))
+		}
+		for i, b := range msgs {
+			got := &grpc_testing.StreamingOutputCallResponse{}
+			if err := protojson.Unmarshal(b, got); err != nil {
+				t.Fatal(err)
+			}
+			if n := len(got.GetPayload().GetBody()); n != i+1 {
+				t.Fatalf("got payload size %d, want %d", n, i+1)
+			}
+		}
+	})
+	t.Run("streamError", func(t *testing.T) {
+		req := &grpc_testing.StreamingOutputCallRequest{
+			ResponseStatus: &grpc_testing.EchoStatus{
+				Code:    int32(codes.NotFound),
+				Message: "missing",
+			},
+		}
+		r := httptest.NewRequest(http.MethodPost, streamPath, bytes.NewReader(envelope(0, marshalProto(req))))
+		r.Header.Set("Content-Type", "application/connect+proto")
+		w := serve(r)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("got status %d: %s", w.Code, w.Body.String())
+		}
+		msgs, end := readStream(t, w.Body.Bytes())
+		if len(msgs) != 0 {
+			t.Fatalf("got %d messages", len(msgs))
+		}
+		if end.Error == nil || end.Error.Code != "not_found" || end.Error.Message != "missing" {
+			t.Fatalf("unexpected error %+v", end.Error)
+		}
+	})
+}
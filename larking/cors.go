@@ -0,0 +1,167 @@
+// Copyright 2024 Edward McFarlane. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package larking
+
+import (
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// corsExposeHeaders are always exposed so browsers can read gRPC-web
+// trailers sent as headers.
+var corsExposeHeaders = []string{
+	"Grpc-Status",
+	"Grpc-Message",
+	"Grpc-Status-Details-Bin",
+}
+
+// CORSPolicy configures cross-origin requests, see CORSOption.
+type CORSPolicy struct {
+	// AllowOrigins are the allowed origins. "*" allows any origin and a
+	// single "*" in an origin matches any subdomain, like
+	// "https://*.example.com".
+	AllowOrigins []string
+	// AllowOriginRegexps are patterns of allowed origins.
+	AllowOriginRegexps []*regexp.Regexp
+	// AllowHeaders are the allowed request headers. If empty, the headers
+	// requested by preflights are allowed.
+	AllowHeaders []string
+	// ExposeHeaders are response headers exposed to the browser, in
+	// addition to the gRPC-web status headers.
+	ExposeHeaders []string
+	// AllowCredentials allows cookies and auth headers.
+	AllowCredentials bool
+	// MaxAge is how long preflight results may be cached.
+	MaxAge time.Duration
+}
+
+// CORSOption enables CORS for HTTP and gRPC-web requests. Preflights are
+// answered by the mux with the methods bound to the requested route.
+func CORSOption(policy CORSPolicy) MuxOption {
+	return func(opts *muxOptions) { opts.cors = &policy }
+}
+
+// allowOrigin reports if the origin is allowed.
+func (p *CORSPolicy) allowOrigin(origin string) bool {
+	for _, o := range p.AllowOrigins {
+		if o == "*" || o == origin {
+			return true
+		}
+		if i := strings.IndexByte(o, '*'); i != -1 {
+			prefix, suffix := o[:i], o[i+1:]
+			if len(origin) >= len(prefix)+len(suffix) &&
+				strings.HasPrefix(origin, prefix) &&
+				strings.HasSuffix(origin, suffix) {
+				return true
+			}
+		}
+	}
+	for _, re := range p.AllowOriginRegexps {
+		if re.MatchString(origin) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *CORSPolicy) allowAnyOrigin() bool {
+	for _, o := range p.AllowOrigins {
+		if o == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// serveCORS sets the CORS headers of allowed requests. It reports true if
+// the request was a preflight and has been answered.
+func (m *Mux) serveCORS(w http.ResponseWriter, r *http.Request) bool {
+	p := m.opts.cors
+	origin := r.Header.Get("Origin")
+	if p == nil || origin == "" {
+		return false
+	}
+	h := w.Header()
+	h.Add("Vary", "Origin")
+	if !p.allowOrigin(origin) {
+		return false
+	}
+
+	reqMethod := r.Header.Get("Access-Control-Request-Method")
+	if r.Method != http.MethodOptions || reqMethod == "" {
+		p.setOrigin(h, origin)
+		expose := append(append([]string(nil), corsExposeHeaders...), p.ExposeHeaders...)
+		h.Set("Access-Control-Expose-Headers", strings.Join(expose, ", "))
+		return false
+	}
+
+	// Preflight.
+	h.Add("Vary", "Access-Control-Request-Method")
+	h.Add("Vary", "Access-Control-Request-Headers")
+
+	methods := m.loadState().allowedMethods(strings.TrimSuffix(r.URL.Path, "/"), reqMethod)
+	if methods == nil {
+		return false // not found or not allowed
+	}
+	p.setOrigin(h, origin)
+	h.Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+	if len(p.AllowHeaders) > 0 {
+		h.Set("Access-Control-Allow-Headers", strings.Join(p.AllowHeaders, ", "))
+	} else if reqHeaders := r.Header.Get("Access-Control-Request-Headers"); reqHeaders != "" {
+		h.Set("Access-Control-Allow-Headers", reqHeaders)
+	}
+	if p.MaxAge > 0 {
+		h.Set("Access-Control-Max-Age", strconv.Itoa(int(p.MaxAge/time.Second)))
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
+
+func (p *CORSPolicy) setOrigin(h http.Header, origin string) {
+	if p.allowAnyOrigin() && !p.AllowCredentials {
+		h.Set("Access-Control-Allow-Origin", "*")
+	} else {
+		h.Set("Access-Control-Allow-Origin", origin)
+	}
+	if p.AllowCredentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+// allowedMethods returns the sorted methods bound to the route, or nil if
+// the method isn't allowed.
+func (s *state) allowedMethods(route, method string) []string {
+	if s == nil {
+		return nil
+	}
+	l := &lexer{input: route}
+	if err := lexPath(l); err != nil {
+		return nil
+	}
+	verbs := make(map[string]bool)
+	s.path.allow(l.tokens(), verbs)
+	if verbs["*"] {
+		delete(verbs, "*")
+		verbs[method] = true
+	}
+	if verbs[http.MethodGet] {
+		verbs[http.MethodHead] = true
+	}
+	delete(verbs, kindWebsocket)
+	if !verbs[method] {
+		return nil
+	}
+
+	methods := make([]string, 0, len(verbs))
+	for verb := range verbs {
+		methods = append(methods, verb)
+	}
+	sort.Strings(methods)
+	return methods
+}
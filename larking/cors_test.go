@@ -0,0 +1,139 @@
+// Copyright 2024 Edward McFarlane. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package larking
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+
+	"google.golang.org/genproto/googleapis/api/serviceconfig"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+
+	"larking.io/health"
+)
+
+func TestCORS(t *testing.T) {
+	serviceConfig := &serviceconfig.Service{}
+	health.AddHealthz(serviceConfig)
+
+	mux, err := NewMux(
+		ServiceConfigOption(serviceConfig),
+		CORSOption(CORSPolicy{
+			AllowOrigins:       []string{"https://example.com", "https://*.example.org"},
+			AllowOriginRegexps: []*regexp.Regexp{regexp.MustCompile(`^http://localhost:\d+$`)},
+			ExposeHeaders:      []string{"X-Request-Id"},
+			AllowCredentials:   true,
+			MaxAge:             time.Hour,
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs := health.NewServer()
+	defer hs.Shutdown()
+	mux.RegisterService(&healthpb.Health_ServiceDesc, hs)
+
+	for _, tt := range []struct {
+		name     string
+		method   string
+		path     string
+		header   http.Header
+		wantCode int
+		want     http.Header
+	}{{
+		name:   "preflight",
+		method: http.MethodOptions,
+		path:   "/v1/healthz",
+		header: http.Header{
+			"Origin":                         {"https://example.com"},
+			"Access-Control-Request-Method":  {"GET"},
+			"Access-Control-Request-Headers": {"authorization"},
+		},
+		wantCode: http.StatusNoContent,
+		want: http.Header{
+			"Access-Control-Allow-Origin":      {"https://example.com"},
+			"Access-Control-Allow-Methods":     {"GET, HEAD"},
+			"Access-Control-Allow-Headers":     {"authorization"},
+			"Access-Control-Allow-Credentials": {"true"},
+			"Access-Control-Max-Age":           {"3600"},
+		},
+	}, {
+		name:   "preflightGRPCWeb",
+		method: http.MethodOptions,
+		path:   "/grpc.health.v1.Health/Check",
+		header: http.Header{
+			"Origin":                         {"https://api.example.org"},
+			"Access-Control-Request-Method":  {"POST"},
+			"Access-Control-Request-Headers": {"content-type,x-grpc-web"},
+		},
+		wantCode: http.StatusNoContent,
+		want: http.Header{
+			"Access-Control-Allow-Origin":  {"https://api.example.org"},
+			"Access-Control-Allow-Methods": {"POST"},
+			"Access-Control-Allow-Headers": {"content-type,x-grpc-web"},
+		},
+	}, {
+		name:   "preflightMethodNotAllowed",
+		method: http.MethodOptions,
+		path:   "/v1/healthz",
+		header: http.Header{
+			"Origin":                        {"https://example.com"},
+			"Access-Control-Request-Method": {"DELETE"},
+		},
+		wantCode: http.StatusNoContent,
+		want: http.Header{
+			"Access-Control-Allow-Origin":  nil,
+			"Access-Control-Allow-Methods": nil,
+			"Allow":                        {"GET, HEAD, OPTIONS"},
+		},
+	}, {
+		name:   "originNotAllowed",
+		method: http.MethodGet,
+		path:   "/v1/healthz",
+		header: http.Header{
+			"Origin": {"https://evil.com"},
+		},
+		wantCode: http.StatusOK,
+		want: http.Header{
+			"Access-Control-Allow-Origin": nil,
+		},
+	}, {
+		name:   "request",
+		method: http.MethodGet,
+		path:   "/v1/healthz",
+		header: http.Header{
+			"Origin": {"http://localhost:8080"},
+		},
+		wantCode: http.StatusOK,
+		want: http.Header{
+			"Access-Control-Allow-Origin":      {"http://localhost:8080"},
+			"Access-Control-Allow-Credentials": {"true"},
+			"Access-Control-Expose-Headers":    {"Grpc-Status, Grpc-Message, Grpc-Status-Details-Bin, X-Request-Id"},
+			"Vary":                             {"Origin"},
+		},
+	}} {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.path, nil)
+			for k, v := range tt.header {
+				r.Header[k] = v
+			}
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, r)
+
+			if w.Code != tt.wantCode {
+				t.Fatalf("got status %d, want %d: %s", w.Code, tt.wantCode, w.Body.String())
+			}
+			for k, v := range tt.want {
+				got := w.Header().Values(k)
+				if len(got) != len(v) || (len(v) > 0 && got[0] != v[0]) {
+					t.Errorf("got %s %q, want %q", k, got, v)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,333 @@
+// Copyright 2024 Edward McFarlane. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package larking
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+
+	"github.com/gobwas/ws"
+	"google.golang.org/genproto/googleapis/rpc/code"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	spb "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+// ErrorHandler writes the HTTP error response of the status, replacing the
+// error encoding. Headers of the error, like Allow and Retry-After, are set.
+//
+// The statusCode is the result of the StatusMapper for the matched method,
+// which the handler can't recompute as it doesn't know the method. It's the
+// same code the default encoding writes, 405 for requests with a verb the
+// route doesn't allow, which have the ErrorInfo reason ReasonMethodNotAllowed.
+// Handlers may write a different code.
+type ErrorHandler func(w http.ResponseWriter, r *http.Request, st *status.Status, statusCode int)
+
+// ErrorHandlerOption sets the handler of HTTP error responses. Twirp errors
+// keep the twirp encoding.
+func ErrorHandlerOption(fn ErrorHandler) MuxOption {
+	return func(opts *muxOptions) { opts.errorHandler = fn }
+}
+
+// StatusMapper maps error statuses to HTTP, twirp and websocket close status
+// codes. The method is the full method name, empty if the route didn't match.
+type StatusMapper interface {
+	HTTPStatusCode(method string, st *status.Status) int
+	TwirpStatusCode(method string, st *status.Status) int
+	WSStatusCode(method string, st *status.Status) ws.StatusCode
+}
+
+// DefaultStatusMapper maps statuses by code, refining HTTP status codes by
+// the details. Embed it to override one of the mappings.
+type DefaultStatusMapper struct{}
+
+// HTTPStatusCode implements StatusMapper.
+func (DefaultStatusMapper) HTTPStatusCode(_ string, st *status.Status) int {
+	return errorHTTPStatusCode(st)
+}
+
+// TwirpStatusCode implements StatusMapper.
+func (DefaultStatusMapper) TwirpStatusCode(_ string, st *status.Status) int {
+	return HTTPStatusCode(st.Code())
+}
+
+// WSStatusCode implements StatusMapper.
+func (DefaultStatusMapper) WSStatusCode(_ string, st *status.Status) ws.StatusCode {
+	return WSStatusCode(st.Code())
+}
+
+// StatusMapperOption sets the mapping of error statuses to HTTP status codes
+// for HTTP and twirp errors, and to websocket close codes. The default is
+// DefaultStatusMapper.
+//
+//	type mapper struct{ larking.DefaultStatusMapper }
+//
+//	func (m mapper) HTTPStatusCode(method string, st *status.Status) int {
+//		if st.Code() == codes.FailedPrecondition {
+//			return http.StatusPreconditionFailed
+//		}
+//		return m.DefaultStatusMapper.HTTPStatusCode(method, st)
+//	}
+func StatusMapperOption(mapper StatusMapper) MuxOption {
+	return func(opts *muxOptions) { opts.statusMapper = mapper }
+}
+
+// httpStatusCode is a nil-safe status mapper call.
+func (o *muxOptions) httpStatusCode(method string, st *status.Status, isTwirp bool) int {
+	var sm StatusMapper = DefaultStatusMapper{}
+	if o.statusMapper != nil {
+		sm = o.statusMapper
+	}
+	if isTwirp {
+		return sm.TwirpStatusCode(method, st)
+	}
+	return sm.HTTPStatusCode(method, st)
+}
+
+// wsStatusCode is a nil-safe status mapper call.
+func (o *muxOptions) wsStatusCode(method string, st *status.Status) ws.StatusCode {
+	if sm := o.statusMapper; sm != nil {
+		return sm.WSStatusCode(method, st)
+	}
+	return WSStatusCode(st.Code())
+}
+
+// ErrorEncoder encodes the body of HTTP error responses with the status code.
+// On error the status is encoded as JSON instead.
+type ErrorEncoder func(r *http.Request, st *status.Status, statusCode int) ([]byte, error)
+
+// ErrorEncoderOption registers the error encoder for the content type.
+// Encoders are selected by Accept negotiation with the codecs, replacing the
+// codec encoding of errors for the same content type.
+//
+//	ErrorEncoderOption("application/problem+json", EncodeProblemJSON)
+func ErrorEncoderOption(contentType string, enc ErrorEncoder) MuxOption {
+	return func(opts *muxOptions) {
+		if opts.errorEncoders == nil {
+			opts.errorEncoders = make(map[string]ErrorEncoder)
+		}
+		opts.errorEncoders[contentType] = enc
+	}
+}
+
+// GoogleErrorEnvelopeOption writes JSON errors in the Google API envelope
+// {"error":{"code","message","status","details"}} instead of the Status.
+// BadRequest field violations are also listed as "errors".
+// https://cloud.google.com/apis/design/errors#http_mapping
+func GoogleErrorEnvelopeOption() MuxOption {
+	return func(opts *muxOptions) { opts.googleErrorEnvelope = true }
+}
+
+type googleError struct {
+	Error googleErrorBody `json:"error"`
+}
+
+type googleErrorBody struct {
+	Code    int               `json:"code"`
+	Message string            `json:"message"`
+	Status  string            `json:"status"`
+	Details []json.RawMessage `json:"details,omitempty"`
+	Errors  []googleFieldErr  `json:"errors,omitempty"`
+}
+
+// googleFieldErr is a field level error of a BadRequest violation.
+type googleFieldErr struct {
+	Message  string `json:"message"`
+	Reason   string `json:"reason"`
+	Location string `json:"location"`
+}
+
+// errorHTTPStatusCode returns the HTTP status code of the status, refined by
+// the details for errors without a more specific code.
+func errorHTTPStatusCode(st *status.Status) int {
+	statusCode := HTTPStatusCode(st.Code())
+	for _, detail := range st.Details() {
+		switch d := detail.(type) {
+		case *errdetails.QuotaFailure:
+			if c := st.Code(); c == codes.ResourceExhausted || c == codes.Unknown {
+				return http.StatusTooManyRequests
+			}
+		case *errdetails.ResourceInfo:
+			if st.Code() == codes.Unknown {
+				statusCode = http.StatusNotFound
+			}
+		case *errdetails.BadRequest:
+			if st.Code() == codes.Unknown {
+				statusCode = http.StatusBadRequest
+			}
+		case *errdetails.ErrorInfo:
+			if d.Reason == ReasonMethodNotAllowed && d.Domain == errorDomain {
+				return http.StatusMethodNotAllowed
+			}
+		}
+	}
+	return statusCode
+}
+
+// setErrorHeader sets the Retry-After header from RetryInfo, in seconds.
+func setErrorHeader(h http.Header, st *status.Status) {
+	for _, detail := range st.Details() {
+		if d, ok := detail.(*errdetails.RetryInfo); ok && d.RetryDelay != nil {
+			secs := math.Ceil(d.RetryDelay.AsDuration().Seconds())
+			h.Set("Retry-After", strconv.Itoa(int(secs)))
+			return
+		}
+	}
+}
+
+// localizeStatus picks the LocalizedMessage detail best matching the
+// Accept-Language header as the message, dropping the other locales.
+func localizeStatus(st *status.Status, header http.Header) *status.Status {
+	details := st.Details()
+	var locales []string
+	for _, detail := range details {
+		if d, ok := detail.(*errdetails.LocalizedMessage); ok {
+			locales = append(locales, d.Locale)
+		}
+	}
+	if len(locales) == 0 {
+		return st
+	}
+	locale := negotiateLanguage(header, locales)
+	if locale == "" {
+		return st
+	}
+
+	p := proto.Clone(st.Proto()).(*spb.Status)
+	kept := make([]*anypb.Any, 0, len(p.Details))
+	for i, detail := range details {
+		if d, ok := detail.(*errdetails.LocalizedMessage); ok {
+			if d.Locale != locale {
+				continue
+			}
+			p.Message = d.Message
+			locale = "" // first match only
+		}
+		kept = append(kept, p.Details[i])
+	}
+	p.Details = kept
+	return status.FromProto(p)
+}
+
+// marshalGoogleError marshals the status in the Google API error envelope.
+// Details are marshalled with the options of JSON codecs.
+func marshalGoogleError(c Codec, st *status.Status, statusCode int) ([]byte, error) {
+	opts, _ := jsonMarshalOptions(c)
+	body := googleErrorBody{
+		Code:    statusCode,
+		Message: st.Message(),
+		Status:  code.Code_name[int32(st.Code())],
+	}
+	for _, detail := range st.Proto().Details {
+		b, err := opts.Marshal(detail)
+		if err != nil {
+			return nil, err
+		}
+		body.Details = append(body.Details, b)
+	}
+	for _, detail := range st.Details() {
+		if d, ok := detail.(*errdetails.BadRequest); ok {
+			for _, v := range d.FieldViolations {
+				body.Errors = append(body.Errors, googleFieldErr{
+					Message:  v.Description,
+					Reason:   "invalid",
+					Location: v.Field,
+				})
+			}
+		}
+	}
+	return json.Marshal(&googleError{Error: body})
+}
+
+// problem is a RFC 9457 problem details object. Extension members hold the
+// gRPC code and the google.rpc details.
+// https://www.rfc-editor.org/rfc/rfc9457
+type problem struct {
+	Type     string            `json:"type"`
+	Title    string            `json:"title"`
+	Status   int               `json:"status"`
+	Detail   string            `json:"detail,omitempty"`
+	Instance string            `json:"instance,omitempty"`
+	Code     string            `json:"code"`
+	Reason   string            `json:"reason,omitempty"`
+	Domain   string            `json:"domain,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+	Errors   []problemError    `json:"errors,omitempty"`
+	Links    []problemLink     `json:"links,omitempty"`
+}
+
+type problemError struct {
+	Field  string `json:"field"`
+	Detail string `json:"detail"`
+}
+
+type problemLink struct {
+	Description string `json:"description,omitempty"`
+	URL         string `json:"url"`
+}
+
+// EncodeProblemJSON is an ErrorEncoder of application/problem+json. The
+// type is the first Help link, else "about:blank" titled by the status code.
+// The detail is the message and the instance is the request path. ErrorInfo
+// sets "reason", "domain" and "metadata", BadRequest violations set "errors"
+// and Help links set "links".
+func EncodeProblemJSON(r *http.Request, st *status.Status, statusCode int) ([]byte, error) {
+	p := problem{
+		Type:     "about:blank",
+		Title:    http.StatusText(statusCode),
+		Status:   statusCode,
+		Detail:   st.Message(),
+		Instance: r.URL.Path,
+		Code:     code.Code_name[int32(st.Code())],
+	}
+	for _, detail := range st.Details() {
+		switch d := detail.(type) {
+		case *errdetails.ErrorInfo:
+			p.Reason = d.Reason
+			p.Domain = d.Domain
+			p.Metadata = d.Metadata
+		case *errdetails.BadRequest:
+			for _, v := range d.FieldViolations {
+				p.Errors = append(p.Errors, problemError{
+					Field:  v.Field,
+					Detail: v.Description,
+				})
+			}
+		case *errdetails.Help:
+			for _, link := range d.Links {
+				p.Links = append(p.Links, problemLink{
+					Description: link.Description,
+					URL:         link.Url,
+				})
+			}
+		}
+	}
+	if len(p.Links) > 0 {
+		p.Type = p.Links[0].URL
+		if desc := p.Links[0].Description; desc != "" {
+			p.Title = desc
+		}
+	}
+	return json.Marshal(&p)
+}
+
+// errorContentTypeOffers returns the content types of errors.
+func errorContentTypeOffers(codecOffers []string, encoders map[string]ErrorEncoder) []string {
+	offers := append([]string(nil), codecOffers...)
+	for k := range encoders {
+		if !slices.Contains(offers, k) {
+			offers = append(offers, k)
+		}
+	}
+	sort.Strings(offers)
+	return offers
+}
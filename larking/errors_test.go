@@ -0,0 +1,358 @@
+// Copyright 2024 Edward McFarlane. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package larking
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/google/go-cmp/cmp"
+	"google.golang.org/genproto/googleapis/api/serviceconfig"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	spb "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	grpc_testing "google.golang.org/grpc/interop/grpc_testing"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/protoadapt"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"larking.io/health"
+)
+
+type preconditionStatusMapper struct{ DefaultStatusMapper }
+
+func (m preconditionStatusMapper) HTTPStatusCode(method string, st *status.Status) int {
+	if method == "/grpc.testing.TestService/UnaryCall" && st.Code() == codes.FailedPrecondition {
+		return http.StatusPreconditionFailed
+	}
+	return m.DefaultStatusMapper.HTTPStatusCode(method, st)
+}
+
+func TestStatusCode(t *testing.T) {
+	for c := codes.OK; c <= codes.Unauthenticated+1; c++ {
+		HTTPStatusCode(c) // no panic
+		WSStatusCode(c)
+	}
+	if got := HTTPStatusCode(codes.Unauthenticated + 1); got != http.StatusInternalServerError {
+		t.Errorf("got status %d", got)
+	}
+	if got := WSStatusCode(codes.Unauthenticated + 1); got != ws.StatusInternalServerError {
+		t.Errorf("got status %d", got)
+	}
+}
+
+type errorServer struct {
+	grpc_testing.UnimplementedTestServiceServer
+	err error
+}
+
+func (s *errorServer) UnaryCall(context.Context, *grpc_testing.SimpleRequest) (*grpc_testing.SimpleResponse, error) {
+	return nil, s.err
+}
+
+func TestErrorDetails(t *testing.T) {
+	newStatus := func(t *testing.T, c codes.Code, msg string, details ...protoadapt.MessageV1) error {
+		t.Helper()
+		st, err := status.New(c, msg).WithDetails(details...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return st.Err()
+	}
+	serve := func(t *testing.T, serr error, header http.Header, opts ...MuxOption) *httptest.ResponseRecorder {
+		t.Helper()
+		m, err := NewMux(opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		grpc_testing.RegisterTestServiceServer(m, &errorServer{err: serr})
+
+		r := httptest.NewRequest(http.MethodPost, "/grpc.testing.TestService/UnaryCall", strings.NewReader("{}"))
+		r.Header.Set("Content-Type", "application/json")
+		for k, vs := range header {
+			r.Header[k] = vs
+		}
+		w := httptest.NewRecorder()
+		m.ServeHTTP(w, r)
+		return w
+	}
+	readStatus := func(t *testing.T, w *httptest.ResponseRecorder) *spb.Status {
+		t.Helper()
+		st := &spb.Status{}
+		if err := protojson.Unmarshal(w.Body.Bytes(), st); err != nil {
+			t.Fatal(err)
+		}
+		return st
+	}
+
+	t.Run("retryInfo", func(t *testing.T) {
+		w := serve(t, newStatus(t, codes.ResourceExhausted, "slow down",
+			&errdetails.RetryInfo{RetryDelay: durationpb.New(1200 * time.Millisecond)},
+		), nil)
+		if w.Code != http.StatusTooManyRequests {
+			t.Fatalf("got status %d", w.Code)
+		}
+		if got := w.Header().Get("Retry-After"); got != "2" {
+			t.Fatalf("got Retry-After %q", got)
+		}
+	})
+	t.Run("quotaFailure", func(t *testing.T) {
+		quota := &errdetails.QuotaFailure{Violations: []*errdetails.QuotaFailure_Violation{
+			{Subject: "project:123", Description: "daily limit"},
+		}}
+		w := serve(t, newStatus(t, codes.Unknown, "quota", quota), nil)
+		if w.Code != http.StatusTooManyRequests {
+			t.Fatalf("got status %d", w.Code)
+		}
+		w = serve(t, newStatus(t, codes.FailedPrecondition, "quota", quota), nil)
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("got status %d", w.Code)
+		}
+	})
+	t.Run("resourceInfo", func(t *testing.T) {
+		w := serve(t, newStatus(t, codes.Unknown, "missing",
+			&errdetails.ResourceInfo{ResourceType: "book", ResourceName: "shelves/1/books/2"},
+		), nil)
+		if w.Code != http.StatusNotFound {
+			t.Fatalf("got status %d", w.Code)
+		}
+	})
+	t.Run("badRequest", func(t *testing.T) {
+		w := serve(t, newStatus(t, codes.Unknown, "invalid",
+			&errdetails.BadRequest{FieldViolations: []*errdetails.BadRequest_FieldViolation{
+				{Field: "name", Description: "required"},
+			}},
+		), nil)
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("got status %d", w.Code)
+		}
+		if st := readStatus(t, w); len(st.Details) != 1 {
+			t.Fatalf("got details %v", st.Details)
+		}
+	})
+	t.Run("localizedMessage", func(t *testing.T) {
+		serr := newStatus(t, codes.InvalidArgument, "invalid",
+			&errdetails.LocalizedMessage{Locale: "en-US", Message: "Invalid name"},
+			&errdetails.LocalizedMessage{Locale: "fr-FR", Message: "Nom invalide"},
+			&errdetails.ErrorInfo{Reason: "INVALID_NAME"},
+		)
+		w := serve(t, serr, http.Header{"Accept-Language": {"fr;q=0.9, de"}})
+		st := readStatus(t, w)
+		if st.Message != "Nom invalide" {
+			t.Fatalf("got message %q", st.Message)
+		}
+		if len(st.Details) != 2 {
+			t.Fatalf("got details %v", st.Details)
+		}
+
+		w = serve(t, serr, http.Header{"Accept-Language": {"de"}})
+		if st := readStatus(t, w); st.Message != "invalid" || len(st.Details) != 3 {
+			t.Fatalf("unexpected status %v", st)
+		}
+	})
+	t.Run("problemJSON", func(t *testing.T) {
+		serr := newStatus(t, codes.InvalidArgument, "invalid book",
+			&errdetails.ErrorInfo{Reason: "INVALID_BOOK", Domain: "larking.io", Metadata: map[string]string{"shelf": "1"}},
+			&errdetails.BadRequest{FieldViolations: []*errdetails.BadRequest_FieldViolation{
+				{Field: "name", Description: "required"},
+			}},
+			&errdetails.Help{Links: []*errdetails.Help_Link{
+				{Description: "Invalid book", Url: "https://larking.io/errors/invalid-book"},
+			}},
+		)
+		opt := ErrorEncoderOption("application/problem+json", EncodeProblemJSON)
+
+		w := serve(t, serr, http.Header{"Accept": {"application/problem+json"}}, opt)
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("got status %d", w.Code)
+		}
+		if ct := w.Header().Get("Content-Type"); ct != "application/problem+json" {
+			t.Fatalf("got content type %q", ct)
+		}
+		var got problem
+		if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+			t.Fatal(err)
+		}
+		want := problem{
+			Type:     "https://larking.io/errors/invalid-book",
+			Title:    "Invalid book",
+			Status:   http.StatusBadRequest,
+			Detail:   "invalid book",
+			Instance: "/grpc.testing.TestService/UnaryCall",
+			Code:     "INVALID_ARGUMENT",
+			Reason:   "INVALID_BOOK",
+			Domain:   "larking.io",
+			Metadata: map[string]string{"shelf": "1"},
+			Errors:   []problemError{{Field: "name", Detail: "required"}},
+			Links:    []problemLink{{Description: "Invalid book", URL: "https://larking.io/errors/invalid-book"}},
+		}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Fatal(diff)
+		}
+
+		w = serve(t, newStatus(t, codes.NotFound, "missing"), http.Header{"Accept": {"application/problem+json"}}, opt)
+		got = problem{}
+		if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+			t.Fatal(err)
+		}
+		if got.Type != "about:blank" || got.Title != "Not Found" || got.Status != http.StatusNotFound {
+			t.Fatalf("unexpected problem %s", w.Body.String())
+		}
+
+		// Other content types use the codecs.
+		w = serve(t, serr, nil, opt)
+		if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+			t.Fatalf("got content type %q", ct)
+		}
+	})
+	t.Run("encoderError", func(t *testing.T) {
+		opt := ErrorEncoderOption("application/problem+json", func(*http.Request, *status.Status, int) ([]byte, error) {
+			return nil, errors.New("encoder failed")
+		})
+		w := serve(t, newStatus(t, codes.NotFound, "missing"), http.Header{"Accept": {"application/problem+json"}}, opt)
+		if w.Code != http.StatusNotFound {
+			t.Fatalf("got status %d", w.Code)
+		}
+		if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+			t.Fatalf("got content type %q", ct)
+		}
+		if st := readStatus(t, w); st.Code != int32(codes.NotFound) || st.Message != "missing" {
+			t.Fatalf("unexpected status %v", st)
+		}
+	})
+	t.Run("statusMapper", func(t *testing.T) {
+		serr := newStatus(t, codes.FailedPrecondition, "stale")
+		opt := StatusMapperOption(preconditionStatusMapper{})
+		if w := serve(t, serr, nil, opt); w.Code != http.StatusPreconditionFailed {
+			t.Fatalf("got status %d", w.Code)
+		}
+		if w := serve(t, serr, nil); w.Code != http.StatusBadRequest {
+			t.Fatalf("got default status %d", w.Code)
+		}
+
+		// Twirp keeps the code mapping of the embedded default.
+		twirp := http.Header{"Twirp-Version": {"v7.1.0"}}
+		if w := serve(t, serr, twirp, opt); w.Code != http.StatusBadRequest {
+			t.Fatalf("got twirp status %d", w.Code)
+		}
+		serr = newStatus(t, codes.Unknown, "invalid",
+			&errdetails.BadRequest{FieldViolations: []*errdetails.BadRequest_FieldViolation{
+				{Field: "name", Description: "required"},
+			}},
+		)
+		if w := serve(t, serr, twirp, opt); w.Code != http.StatusInternalServerError {
+			t.Fatalf("got twirp status %d", w.Code)
+		}
+		if w := serve(t, serr, twirp); w.Code != http.StatusInternalServerError {
+			t.Fatalf("got default twirp status %d", w.Code)
+		}
+	})
+	t.Run("errorHandler", func(t *testing.T) {
+		opt := ErrorHandlerOption(func(w http.ResponseWriter, r *http.Request, st *status.Status, statusCode int) {
+			w.Header().Set("Content-Type", "text/html")
+			w.WriteHeader(statusCode)
+			w.Write([]byte("<h1>" + st.Message() + "</h1>")) //nolint
+		})
+		w := serve(t, newStatus(t, codes.ResourceExhausted, "slow down",
+			&errdetails.RetryInfo{RetryDelay: durationpb.New(time.Second)},
+		), nil, opt)
+		if w.Code != http.StatusTooManyRequests || w.Body.String() != "<h1>slow down</h1>" {
+			t.Fatalf("unexpected response %d: %s", w.Code, w.Body.String())
+		}
+		if got := w.Header().Get("Retry-After"); got != "1" {
+			t.Fatalf("got Retry-After %q", got)
+		}
+
+		// Twirp keeps the twirp encoding.
+		w = serve(t, newStatus(t, codes.NotFound, "missing"), http.Header{"Twirp-Version": {"v7.1.0"}}, opt)
+		if w.Code != http.StatusNotFound || !strings.Contains(w.Body.String(), `"code":"not_found"`) {
+			t.Fatalf("unexpected twirp response %d: %s", w.Code, w.Body.String())
+		}
+	})
+	t.Run("googleErrorEnvelope", func(t *testing.T) {
+		w := serve(t, newStatus(t, codes.InvalidArgument, "invalid",
+			&errdetails.BadRequest{FieldViolations: []*errdetails.BadRequest_FieldViolation{
+				{Field: "name", Description: "required"},
+			}},
+		), nil, GoogleErrorEnvelopeOption())
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("got status %d", w.Code)
+		}
+
+		var got struct {
+			Error struct {
+				Code    int               `json:"code"`
+				Message string            `json:"message"`
+				Status  string            `json:"status"`
+				Details []json.RawMessage `json:"details"`
+				Errors  []googleFieldErr  `json:"errors"`
+			} `json:"error"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+			t.Fatal(err)
+		}
+		if got.Error.Code != 400 || got.Error.Message != "invalid" || got.Error.Status != "INVALID_ARGUMENT" {
+			t.Fatalf("unexpected error %s", w.Body.String())
+		}
+		if len(got.Error.Details) != 1 || !strings.Contains(string(got.Error.Details[0]), "google.rpc.BadRequest") {
+			t.Fatalf("unexpected details %s", w.Body.String())
+		}
+		want := []googleFieldErr{{Message: "required", Reason: "invalid", Location: "name"}}
+		if diff := cmp.Diff(want, got.Error.Errors); diff != "" {
+			t.Fatal(diff)
+		}
+	})
+}
+
+func TestErrorHandlerMethodNotAllowed(t *testing.T) {
+	serviceConfig := &serviceconfig.Service{}
+	health.AddHealthz(serviceConfig)
+
+	var (
+		gotCode   int
+		gotReason string
+	)
+	m, err := NewMux(
+		ServiceConfigOption(serviceConfig),
+		StatusMapperOption(preconditionStatusMapper{}),
+		ErrorHandlerOption(func(w http.ResponseWriter, r *http.Request, st *status.Status, statusCode int) {
+			gotCode = statusCode
+			for _, detail := range st.Details() {
+				if d, ok := detail.(*errdetails.ErrorInfo); ok {
+					gotReason = d.Reason
+				}
+			}
+			w.WriteHeader(statusCode)
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs := health.NewServer()
+	defer hs.Shutdown()
+	m.RegisterService(&healthpb.Health_ServiceDesc, hs)
+
+	r := httptest.NewRequest(http.MethodPost, "/v1/healthz", nil)
+	w := httptest.NewRecorder()
+	m.ServeHTTP(w, r)
+
+	if w.Code != http.StatusMethodNotAllowed || gotCode != http.StatusMethodNotAllowed {
+		t.Fatalf("got status %d, handler status %d", w.Code, gotCode)
+	}
+	if gotReason != ReasonMethodNotAllowed {
+		t.Fatalf("got reason %q", gotReason)
+	}
+	if got := w.Header().Get("Allow"); got != "GET, HEAD, OPTIONS" {
+		t.Fatalf("got Allow %q", got)
+	}
+}
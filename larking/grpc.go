@@ -273,7 +273,6 @@ func (s *streamGRPC) SendMsg(m interface{}) error {
 		return err
 	}
 
-	reply := m.(proto.Message)
 	if !s.sentHeader {
 		if err := s.SendHeader(nil); err != nil {
 			return err
@@ -294,9 +293,17 @@ func (s *streamGRPC) SendMsg(m interface{}) error {
 	b = b[:5] // 1 byte compression flag, 4 bytes message length
 
 	var err error
-	b, err = s.codec.MarshalAppend(b, reply)
-	if err != nil {
-		return err
+	if f, ok := m.(*frame); ok {
+		fb, err := f.bytes()
+		if err != nil {
+			return err
+		}
+		b = append(b, fb...)
+	} else {
+		b, err = s.codec.MarshalAppend(b, m)
+		if err != nil {
+			return err
+		}
 	}
 
 	var size uint32
@@ -336,7 +343,7 @@ func (s *streamGRPC) SendMsg(m interface{}) error {
 	if stats := s.opts.statsHandler; stats != nil {
 		// TODO: raw payload stats.
 		b := b[headerLen:] // shadow
-		stats.HandleRPC(s.ctx, outPayload(false, m, b, time.Now()))
+		stats.HandleRPC(s.ctx, outPayload(false, statsPayload(m), b, time.Now()))
 	}
 	return nil
 }
@@ -362,8 +369,6 @@ func (s *streamGRPC) RecvMsg(m interface{}) error {
 		return err
 	}
 
-	args := m.(proto.Message)
-
 	bp := bytesPool.Get().(*[]byte)
 	b := (*bp)[:0]
 	defer func() {
@@ -398,12 +403,14 @@ func (s *streamGRPC) RecvMsg(m interface{}) error {
 		return err
 	}
 
+	f, isFrame := m.(*frame)
 	if isCompressed {
 		// compressed
 		if s.comp == nil {
 			return fmt.Errorf("grpc: Decompressor is not installed for grpc-encoding %q", s.messageEncoding)
 		}
-
+	}
+	if isCompressed && !isFrame {
 		buf := bufPool.Get().(*bytes.Buffer)
 		buf.Reset()
 		if err := s.decompress(buf, b); err != nil {
@@ -419,17 +426,30 @@ func (s *streamGRPC) RecvMsg(m interface{}) error {
 		bufPool.Put(buf)
 	}
 
-	if err := s.codec.Unmarshal(b, args); err != nil {
+	if isFrame {
+		// Frames keep the wire bytes, decompressed when needed.
+		f.b = append(f.b[:0], b...)
+		f.comp = nil
+		if isCompressed {
+			f.comp = s.comp
+		}
+	} else if err := s.codec.Unmarshal(b, m); err != nil {
 		return err
 	}
 	if stats := s.opts.statsHandler; stats != nil {
 		// TODO: raw payload stats.
-		b := b[headerLen:] // shadow
-		stats.HandleRPC(s.ctx, inPayload(false, m, b, time.Now()))
+		stats.HandleRPC(s.ctx, inPayload(false, statsPayload(m), b, time.Now()))
 	}
 	return nil
 }
 
+// isFrameStream reports whether the messages of the stream can be forwarded
+// as raw frames: a native gRPC stream using the proto codec.
+func isFrameStream(stream grpc.ServerStream) bool {
+	s, ok := stream.(*streamGRPC)
+	return ok && s.codec.Name() == "proto"
+}
+
 func (m *Mux) grpcGetCodec(ct string) (Codec, bool) {
 	typ, enc, ok := strings.Cut(ct, "+")
 	if !ok {
@@ -504,10 +524,21 @@ func (m *Mux) serveGRPC(w http.ResponseWriter, r *http.Request) {
 
 	method := r.URL.Path
 	s := m.loadState()
-	hd, err := s.pickMethodHandler(method)
+	hd, err := s.pickMethodHandler(m.opts.picker, method, md)
 	if err != nil {
-		msg := fmt.Sprintf("no handler for gRPC method %q", method)
-		http.Error(w, msg, http.StatusNotFound)
+		if status.Code(err) == codes.Unimplemented {
+			msg := fmt.Sprintf("no handler for gRPC method %q", method)
+			http.Error(w, msg, http.StatusNotFound)
+			return
+		}
+
+		// Trailers only response.
+		st := status.Convert(err)
+		h := w.Header()
+		h.Set("Content-Type", contentType)
+		h.Set("Grpc-Status", strconv.FormatInt(int64(st.Code()), 10))
+		h.Set("Grpc-Message", encodeGrpcMessage(st.Message()))
+		w.WriteHeader(http.StatusOK)
 		return
 	}
 
@@ -561,7 +592,7 @@ func (m *Mux) serveGRPC(w http.ResponseWriter, r *http.Request) {
 		stream.wg.Wait()
 	}()
 
-	herr := hd.handler(&m.opts, stream)
+	herr := hd.serve(&m.opts, stream)
 	if !stream.sentHeader {
 		if err := stream.SendHeader(nil); err != nil {
 			return // ctx canceled
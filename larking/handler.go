@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"log"
 	"reflect"
+	"sync/atomic"
 
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/metadata"
@@ -17,9 +18,18 @@ import (
 type handlerFunc func(*muxOptions, grpc.ServerStream) error
 
 type handler struct {
-	desc    protoreflect.MethodDescriptor
-	handler handlerFunc
-	method  string // /Service/Method
+	desc        protoreflect.MethodDescriptor
+	handler     handlerFunc
+	method      string           // /Service/Method
+	conn        *grpc.ClientConn // nil for local services
+	outstanding atomic.Int64     // calls in flight
+}
+
+// serve calls the handler tracking the outstanding calls.
+func (h *handler) serve(opts *muxOptions, stream grpc.ServerStream) error {
+	h.outstanding.Add(1)
+	defer h.outstanding.Add(-1)
+	return h.handler(opts, stream)
 }
 
 // TODO: use grpclog?
@@ -88,7 +98,7 @@ func (m *Mux) registerService(gsd *grpc.ServiceDesc, ss interface{}) error {
 			},
 		}
 
-		if err := s.appendHandler(m.opts, md, h); err != nil {
+		if err := s.appendHandler(md, h); err != nil {
 			return err
 		}
 	}
@@ -113,7 +123,7 @@ func (m *Mux) registerService(gsd *grpc.ServiceDesc, ss interface{}) error {
 				return opts.stream(ss, stream, info, d.Handler)
 			},
 		}
-		if err := s.appendHandler(m.opts, md, h); err != nil {
+		if err := s.appendHandler(md, h); err != nil {
 			return err
 		}
 	}
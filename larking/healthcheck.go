@@ -0,0 +1,158 @@
+// Copyright 2024 Edward McFarlane. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package larking
+
+import (
+	"context"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+// healthRetryDelay is the delay before rewatching a failed health stream.
+const healthRetryDelay = time.Second
+
+// HealthCheckOption enables health-aware routing of registered conns. Each
+// conn is watched with grpc.health.v1.Health/Watch for the service, where ""
+// is the health of the whole server. If the health service is unimplemented
+// the connectivity state of the conn is watched instead. Handlers of conns
+// that are not serving, or in transient failure, are excluded from picks
+// until the conn recovers.
+func HealthCheckOption(service string) MuxOption {
+	return func(opts *muxOptions) {
+		opts.healthCheck = true
+		opts.healthService = service
+	}
+}
+
+// HealthHookOption sets a hook called when the health of a registered conn
+// changes. Conns start healthy.
+func HealthHookOption(fn func(cc *grpc.ClientConn, healthy bool)) MuxOption {
+	return func(opts *muxOptions) { opts.healthHook = fn }
+}
+
+// watchHealth starts the health watcher of cc, if enabled.
+// Only the latest watcher for each conn is kept running.
+func (m *Mux) watchHealth(ctx context.Context, cc *grpc.ClientConn) {
+	if !m.opts.healthCheck {
+		return
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	w := &connWatcher{cancel: cancel}
+
+	m.mu.Lock()
+	if prev, ok := m.healthWatchers[cc]; ok {
+		prev.cancel()
+	}
+	if m.healthWatchers == nil {
+		m.healthWatchers = make(map[*grpc.ClientConn]*connWatcher)
+	}
+	m.healthWatchers[cc] = w
+	m.mu.Unlock()
+
+	go func() {
+		defer func() {
+			m.mu.Lock()
+			if m.healthWatchers[cc] == w {
+				delete(m.healthWatchers, cc)
+			}
+			m.mu.Unlock()
+			cancel()
+		}()
+
+		client := healthpb.NewHealthClient(cc)
+		for ctx.Err() == nil {
+			err := m.watchHealthStream(ctx, cc, client)
+			if status.Code(err) == codes.Unimplemented {
+				m.watchHealthState(ctx, cc)
+				return
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			m.setConnHealth(ctx, cc, false)
+
+			select {
+			case <-ctx.Done():
+			case <-time.After(healthRetryDelay):
+			}
+		}
+	}()
+}
+
+// watchHealthStream updates the health of cc from the health service.
+func (m *Mux) watchHealthStream(ctx context.Context, cc *grpc.ClientConn, client healthpb.HealthClient) error {
+	stream, err := client.Watch(ctx, &healthpb.HealthCheckRequest{
+		Service: m.opts.healthService,
+	})
+	if err != nil {
+		return err
+	}
+	for {
+		rsp, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		healthy := rsp.GetStatus() == healthpb.HealthCheckResponse_SERVING
+		m.setConnHealth(ctx, cc, healthy)
+	}
+}
+
+// watchHealthState updates the health of cc from the connectivity state.
+func (m *Mux) watchHealthState(ctx context.Context, cc *grpc.ClientConn) {
+	for last := cc.GetState(); ; last = cc.GetState() {
+		healthy := last != connectivity.TransientFailure && last != connectivity.Shutdown
+		m.setConnHealth(ctx, cc, healthy)
+		if !cc.WaitForStateChange(ctx, last) {
+			return
+		}
+	}
+}
+
+// setConnHealth updates the state if the health of cc changed.
+func (m *Mux) setConnHealth(ctx context.Context, cc *grpc.ClientConn, healthy bool) {
+	m.mu.Lock()
+	s := m.loadState()
+	if s == nil || ctx.Err() != nil {
+		m.mu.Unlock()
+		return // dropped
+	}
+	if _, ok := s.conns[cc]; !ok || s.unhealthy[cc] == !healthy {
+		m.mu.Unlock()
+		return // nothing to do
+	}
+
+	// Load the state for writing.
+	s = s.clone()
+	if healthy {
+		delete(s.unhealthy, cc)
+	} else {
+		s.unhealthy[cc] = true
+	}
+	m.storeState(s)
+	m.mu.Unlock()
+
+	if hook := m.opts.healthHook; hook != nil {
+		hook(cc, healthy)
+	}
+}
+
+// healthyHandlers filters out the handlers of unhealthy conns.
+func (s *state) healthyHandlers(hds []*handler) []*handler {
+	if len(s.unhealthy) == 0 {
+		return hds
+	}
+	healthy := make([]*handler, 0, len(hds))
+	for _, hd := range hds {
+		if hd.conn == nil || !s.unhealthy[hd.conn] {
+			healthy = append(healthy, hd)
+		}
+	}
+	return healthy
+}
@@ -0,0 +1,116 @@
+// Copyright 2024 Edward McFarlane. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package larking
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+
+	"larking.io/api/testpb"
+)
+
+func TestHealthCheck(t *testing.T) {
+	const method = "/larking.testpb.Messaging/GetMessageOne"
+
+	for _, tt := range []struct {
+		name       string
+		withHealth bool
+	}{
+		{"watch", true},
+		{"connectivity", false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			gs := grpc.NewServer()
+			testpb.RegisterMessagingServer(gs, &testpb.UnimplementedMessagingServer{})
+			hs := health.NewServer()
+			if tt.withHealth {
+				healthpb.RegisterHealthServer(gs, hs)
+			}
+			reflection.Register(gs)
+
+			lis, err := net.Listen("tcp", "localhost:0")
+			if err != nil {
+				t.Fatalf("failed to listen: %v", err)
+			}
+			go gs.Serve(lis) //nolint
+			defer gs.Stop()
+
+			conn, err := grpc.Dial(lis.Addr().String(),
+				grpc.WithTransportCredentials(insecure.NewCredentials()),
+			)
+			if err != nil {
+				t.Fatalf("cannot connect to server: %v", err)
+			}
+			defer conn.Close()
+
+			var (
+				mu     sync.Mutex
+				events []bool
+			)
+			mux, err := NewMux(
+				HealthCheckOption(""),
+				HealthHookOption(func(cc *grpc.ClientConn, healthy bool) {
+					if cc != conn {
+						t.Errorf("unexpected conn %v", cc)
+					}
+					mu.Lock()
+					events = append(events, healthy)
+					mu.Unlock()
+				}),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if err := mux.RegisterConn(ctx, conn); err != nil {
+				t.Fatal(err)
+			}
+
+			waitFor := func(code codes.Code) {
+				t.Helper()
+				deadline := time.Now().Add(10 * time.Second)
+				for {
+					_, err := mux.loadState().pickMethodHandler(nil, method, nil)
+					if status.Code(err) == code {
+						return
+					}
+					if time.Now().After(deadline) {
+						t.Fatalf("timeout waiting for %v, got %v", code, err)
+					}
+					time.Sleep(10 * time.Millisecond)
+				}
+			}
+			waitFor(codes.OK)
+
+			if tt.withHealth {
+				hs.SetServingStatus("", healthpb.HealthCheckResponse_NOT_SERVING)
+				waitFor(codes.Unavailable)
+				hs.SetServingStatus("", healthpb.HealthCheckResponse_SERVING)
+				waitFor(codes.OK)
+			} else {
+				gs.Stop()
+				waitFor(codes.Unavailable)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if len(events) == 0 || events[0] {
+				t.Fatalf("unexpected health events %v", events)
+			}
+		})
+	}
+}
@@ -3,14 +3,13 @@ package larking
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
-	"strings"
 	"time"
 
 	"github.com/gobwas/ws"
-	"google.golang.org/genproto/googleapis/rpc/code"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/metadata"
@@ -38,8 +37,9 @@ type streamHTTP struct {
 	recvCount      int
 	sendCount      int
 	sentHeader     bool
-	hasBody        bool // HTTP method has a body
-	rEOF           bool // stream read EOF
+	hasBody        bool         // HTTP method has a body
+	rEOF           bool         // stream read EOF
+	events         *eventWriter // server-sent events, if accepted
 }
 
 var _ grpc.ServerStream = (*streamHTTP)(nil)
@@ -92,10 +92,13 @@ func (s *streamHTTP) writeMsg(c Codec, b []byte, contentType string) (int, error
 		}
 	}
 	s.sendCount += 1
+	if s.events != nil {
+		return count, s.events.writeEvent("", b)
+	}
 	if s.method.desc.IsStreamingServer() {
 		codec, ok := c.(StreamCodec)
 		if !ok {
-			return count, fmt.Errorf("codec %s does not support streaming", codec.Name())
+			return count, fmt.Errorf("codec %s does not support streaming", c.Name())
 		}
 		_, err := codec.WriteNext(s.w, b)
 		return count, err
@@ -110,16 +113,20 @@ func (s *streamHTTP) SendMsg(m interface{}) error {
 		defer fRsp.Flush()
 	}
 
-	cur := reply.ProtoReflect()
-	for _, fd := range s.method.resp {
-		cur = cur.Mutable(fd).Message()
-	}
-	msg := cur.Interface()
+	cur, fd := s.method.responseBody(reply.ProtoReflect())
 
 	contentType := s.accept
-	c, err := s.getCodec(contentType, cur)
-	if err != nil {
-		return err
+	var c Codec
+	if fd != nil {
+		var ok bool
+		if c, ok = s.opts.codecs[contentType]; !ok {
+			return status.Errorf(codes.Internal, "no codec registered for content-type %q", contentType)
+		}
+	} else {
+		var err error
+		if c, err = s.getCodec(contentType, cur); err != nil {
+			return err
+		}
 	}
 
 	bytes := bytesPool.Get().(*[]byte)
@@ -131,7 +138,13 @@ func (s *streamHTTP) SendMsg(m interface{}) error {
 		}
 	}()
 
-	if cur.Descriptor().FullName() == "google.api.HttpBody" {
+	if fd != nil {
+		var err error
+		b, err = marshalFieldAppend(c, b, cur, fd)
+		if err != nil {
+			return status.Errorf(codes.Internal, "%s: error while marshaling: %v", c.Name(), err)
+		}
+	} else if cur.Descriptor().FullName() == "google.api.HttpBody" {
 		fds := cur.Descriptor().Fields()
 		fdContentType := fds.ByName(protoreflect.Name("content_type"))
 		fdData := fds.ByName(protoreflect.Name("data"))
@@ -142,7 +155,7 @@ func (s *streamHTTP) SendMsg(m interface{}) error {
 		contentType = pContentType.String()
 	} else {
 		var err error
-		b, err = c.MarshalAppend(b, msg)
+		b, err = c.MarshalAppend(b, cur.Interface())
 		if err != nil {
 			return status.Errorf(codes.Internal, "%s: error while marshaling: %v", c.Name(), err)
 		}
@@ -168,7 +181,7 @@ func (s *streamHTTP) readMsg(c Codec, b []byte) (int, []byte, error) {
 	if s.method.desc.IsStreamingClient() {
 		codec, ok := c.(StreamCodec)
 		if !ok {
-			return count, nil, fmt.Errorf("codec %q does not support streaming", codec.Name())
+			return count, nil, fmt.Errorf("codec %q does not support streaming", c.Name())
 		}
 		b = append(b, s.rbuf...)
 		b, n, err := codec.ReadNext(b, s.r, s.opts.maxReceiveMessageSize)
@@ -283,26 +296,50 @@ func isWebsocketRequest(r *http.Request) bool {
 	return false
 }
 
-type twirpError struct {
-	Code    string            `json:"code"`
-	Message string            `json:"msg"`
-	Meta    map[string]string `json:"meta"`
+// headResponseWriter discards the body of HEAD responses.
+type headResponseWriter struct {
+	http.ResponseWriter
 }
 
-func (m *Mux) encError(w http.ResponseWriter, r *http.Request, err error) {
+func (w headResponseWriter) Write(b []byte) (int, error) { return len(b), nil }
+
+func (w headResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// encError writes the error response of the method, empty if the route
+// didn't match. Trailers are only used by twirp meta.
+func (m *Mux) encError(w http.ResponseWriter, r *http.Request, err error, method string, trailer metadata.MD) {
 	s, _ := status.FromError(err)
-	if isTwirp := r.Header.Get("Twirp-Version") != ""; isTwirp {
+	s = localizeStatus(s, r.Header)
+	setErrorHeader(w.Header(), s)
+	isTwirp := r.Header.Get("Twirp-Version") != ""
+	statusCode := m.opts.httpStatusCode(method, s, isTwirp)
+	var merr *methodNotAllowedError
+	if errors.As(err, &merr) {
+		w.Header().Set("Allow", merr.Allow())
+		statusCode = http.StatusMethodNotAllowed
+	}
+	if fn := m.opts.errorHandler; fn != nil && !isTwirp {
+		fn(w, r, s, statusCode)
+		return
+	}
+	if isTwirp {
 		accept := "application/json"
 
 		w.Header().Set("Content-Type", accept)
-		w.WriteHeader(HTTPStatusCode(s.Code()))
-
-		codeStr := strings.ToLower(code.Code_name[int32(s.Code())])
+		w.WriteHeader(statusCode)
 
 		terr := &twirpError{
-			Code:    codeStr,
+			Code:    twirpCode(s.Code()),
 			Message: s.Message(),
 		}
+		if fn := m.opts.twirpErrorMeta; fn != nil {
+			terr.Meta = fn(s, trailer)
+		}
+		terr.Meta = appendTwirpTrailers(terr.Meta, trailer, m.opts.twirpErrorTrailers)
 		b, err := json.Marshal(terr)
 		if err != nil {
 			panic(err) // ...
@@ -312,16 +349,35 @@ func (m *Mux) encError(w http.ResponseWriter, r *http.Request, err error) {
 
 	}
 
-	accept := negotiateContentType(r.Header, m.opts.contentTypeOffers, "application/json")
-	c := m.opts.codecs[accept]
-
-	w.Header().Set("Content-Type", accept)
-	w.WriteHeader(HTTPStatusCode(s.Code()))
+	accept := negotiateContentType(r.Header, m.opts.errorContentOffers, "application/json")
+	if accept == eventStream {
+		accept = "application/json" // errors before the stream
+	}
 
-	b, err := c.Marshal(s.Proto())
+	c := m.opts.codecs[accept]
+	var b []byte
+	if enc, ok := m.opts.errorEncoders[accept]; ok {
+		b, err = enc(r, s, statusCode)
+	} else if m.opts.googleErrorEnvelope && accept == "application/json" {
+		b, err = marshalGoogleError(c, s, statusCode)
+	} else {
+		b, err = c.Marshal(s.Proto())
+	}
 	if err != nil {
-		panic(err) // ...
+		// Fallback to the status as JSON, or the message as text.
+		accept = "application/json"
+		c, ok := m.opts.codecs[accept]
+		if !ok {
+			c = CodecJSON{}
+		}
+		if b, err = c.Marshal(s.Proto()); err != nil {
+			accept = "text/plain; charset=utf-8"
+			b = []byte(s.Message())
+		}
 	}
+
+	w.Header().Set("Content-Type", accept)
+	w.WriteHeader(statusCode)
 	w.Write(b) //nolint
 }
 
@@ -338,18 +394,29 @@ func (m *Mux) serveHTTP(w http.ResponseWriter, r *http.Request) error {
 
 	method, params, err := s.match(r.URL.Path, verb)
 	if err != nil {
+		var merr *methodNotAllowedError
+		if r.Method == http.MethodOptions && errors.As(err, &merr) {
+			w.Header().Set("Allow", merr.Allow())
+			w.WriteHeader(http.StatusNoContent)
+			return nil
+		}
 		return err
 	}
+	if r.Method == http.MethodHead {
+		w = headResponseWriter{w}
+	}
 
-	queryParams, err := method.parseQueryParams(r.URL.Query())
+	queryParams, err := method.parseQueryParams(r.URL.Query(), m.opts.types)
 	if err != nil {
-		return err
+		m.encError(w, r, err, method.name, nil)
+		return nil
 	}
 	params = append(params, queryParams...)
 
-	hd, err := s.pickMethodHandler(method.name)
+	hd, err := s.pickMethodHandler(m.opts.picker, method.name, mdata)
 	if err != nil {
-		return err
+		m.encError(w, r, err, method.name, nil)
+		return nil
 	}
 
 	// Handle stats.
@@ -378,25 +445,41 @@ func (m *Mux) serveHTTP(w http.ResponseWriter, r *http.Request) error {
 	}
 
 	if isWebsocket {
-		conn, _, _, err := ws.UpgradeHTTP(r, w)
+		upgrader := ws.HTTPUpgrader{
+			Protocol: func(p string) bool {
+				_, ok := m.opts.websocketCodec(p)
+				return ok
+			},
+		}
+		conn, _, hs, err := upgrader.Upgrade(r, w)
 		if err != nil {
 			return err
 		}
 		defer conn.Close()
 
+		codec, ok := m.opts.websocketCodec(hs.Protocol)
+		if !ok {
+			codec = m.opts.codecs["application/json"]
+		}
 		stream := &streamWS{
-			ctx:    ctx,
-			conn:   conn,
-			method: method,
-			params: params,
+			ctx:      ctx,
+			conn:     conn,
+			method:   method,
+			opts:     &m.opts,
+			codec:    codec,
+			protocol: hs.Protocol,
+			params:   params,
+		}
+		herr := hd.serve(&m.opts, stream)
+		if ferr := stream.finish(); herr == nil {
+			herr = ferr
 		}
-		herr := hd.handler(&m.opts, stream)
 
 		if herr != nil {
 			s, _ := status.FromError(herr)
 			// TODO: limit message size.
 
-			code := WSStatusCode(s.Code())
+			code := m.opts.wsStatusCode(method.name, s)
 			f := ws.NewCloseFrame(ws.NewCloseFrameBody(code, s.Message()))
 			b, err := ws.CompileFrame(f)
 			if err != nil {
@@ -440,7 +523,14 @@ func (m *Mux) serveHTTP(w http.ResponseWriter, r *http.Request) error {
 	}
 
 	accept := negotiateContentType(r.Header, m.opts.contentTypeOffers, contentType)
-	acceptEncoding := negotiateContentEncoding(r.Header, m.opts.encodingTypeOffers)
+	isEventStream := accept == eventStream && method.desc.IsStreamingServer()
+	if accept == eventStream && !isEventStream {
+		accept = contentType
+	}
+	var acceptEncoding string
+	if !isEventStream {
+		acceptEncoding = negotiateContentEncoding(r.Header, m.opts.encodingTypeOffers)
+	}
 
 	var resp io.Writer = w
 	if cz := m.opts.compressors[acceptEncoding]; cz != nil {
@@ -472,7 +562,33 @@ func (m *Mux) serveHTTP(w http.ResponseWriter, r *http.Request) error {
 		acceptEncoding: acceptEncoding,
 		hasBody:        r.ContentLength > 0 || r.ContentLength == -1,
 	}
-	herr := hd.handler(&m.opts, stream)
+	stopHeartbeat := func() {}
+	if isEventStream {
+		h := w.Header()
+		h.Set("Content-Type", eventStream)
+		h.Set("Cache-Control", "no-cache")
+		stream.events = newEventWriter(w, r.Header.Get("Last-Event-ID"))
+		stream.w = stream.events
+
+		// Headers are sent as the stream starts, heartbeats keep idle
+		// streams open before the first event.
+		if err := stream.SendHeader(nil); err != nil {
+			return err
+		}
+		w.WriteHeader(http.StatusOK)
+		stream.events.Flush()
+		if d := m.opts.eventStreamHeartbeat; d > 0 {
+			hctx, cancel := context.WithCancel(ctx)
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				stream.events.heartbeat(hctx, d)
+			}()
+			stopHeartbeat = func() { cancel(); <-done }
+		}
+	}
+	herr := hd.serve(&m.opts, stream)
+	stopHeartbeat()
 	// Handle stats.
 	if sh := m.opts.statsHandler; sh != nil {
 		endTime := time.Now()
@@ -491,10 +607,19 @@ func (m *Mux) serveHTTP(w http.ResponseWriter, r *http.Request) error {
 		})
 	}
 	if herr != nil {
+		if stream.events != nil {
+			// Errors end the event stream.
+			st, _ := status.FromError(herr)
+			b, err := (CodecJSON{}).Marshal(st.Proto())
+			if err != nil {
+				return err
+			}
+			return stream.events.writeEvent(eventStreamErrorEvent, b)
+		}
 		if !stream.sentHeader {
 			w.Header().Set("Content-Encoding", "identity") // try to avoid gzip
 		}
-		m.encError(w, r, herr)
+		m.encError(w, r, herr, method.name, stream.trailer)
 	}
 	return nil
 }
@@ -3,14 +3,23 @@ package larking
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"io"
 	"math/rand"
+	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 
+	"github.com/google/go-cmp/cmp"
+	"google.golang.org/genproto/googleapis/api/annotations"
 	"google.golang.org/genproto/googleapis/api/httpbody"
+	"google.golang.org/genproto/googleapis/api/serviceconfig"
 	"google.golang.org/grpc/codes"
+	grpc_testing "google.golang.org/grpc/interop/grpc_testing"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/testing/protocmp"
 	"larking.io/api/testpb"
 )
 
@@ -93,3 +102,126 @@ func TestAsHTTPBody(t *testing.T) {
 		t.Errorf("bytes not equal: %d != %d", len(b), len(w.Body.Bytes()))
 	}
 }
+
+type responseBodyServer struct {
+	grpc_testing.UnimplementedTestServiceServer
+}
+
+func (s *responseBodyServer) UnaryCall(ctx context.Context, req *grpc_testing.SimpleRequest) (*grpc_testing.SimpleResponse, error) {
+	return &grpc_testing.SimpleResponse{
+		Payload:  req.Payload,
+		Username: "larking",
+	}, nil
+}
+
+func (s *responseBodyServer) StreamingOutputCall(req *grpc_testing.StreamingOutputCallRequest, stream grpc_testing.TestService_StreamingOutputCallServer) error {
+	for _, p := range req.ResponseParameters {
+		if err := stream.Send(&grpc_testing.StreamingOutputCallResponse{
+			Payload: &grpc_testing.Payload{Body: bytes.Repeat([]byte{'a'}, int(p.Size))},
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestResponseBody(t *testing.T) {
+	rule := func(selector, get, responseBody string) *annotations.HttpRule {
+		return &annotations.HttpRule{
+			Selector:     selector,
+			Pattern:      &annotations.HttpRule_Get{Get: get},
+			ResponseBody: responseBody,
+		}
+	}
+	m, err := NewMux(ServiceConfigOption(&serviceconfig.Service{
+		Http: &annotations.Http{Rules: []*annotations.HttpRule{
+			rule("grpc.testing.TestService.UnaryCall", "/v1/payload", "payload"),
+		}},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	grpc_testing.RegisterTestServiceServer(m, &responseBodyServer{})
+
+	do := func(t *testing.T, method, target, body string) string {
+		t.Helper()
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		m.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("unexpected status %d: %s", w.Code, w.Body.String())
+		}
+		return w.Body.String()
+	}
+	get := func(t *testing.T, target string) string {
+		t.Helper()
+		return do(t, http.MethodGet, target, "")
+	}
+
+	t.Run("message", func(t *testing.T) {
+		got := get(t, "/v1/payload?payload.body=aGk=")
+		if want := `{"body":"aGk="}`; got != want {
+			t.Fatalf("got %s, want %s", got, want)
+		}
+	})
+	t.Run("scalar", func(t *testing.T) {
+		if err := m.SetServiceConfig(&serviceconfig.Service{
+			Http: &annotations.Http{Rules: []*annotations.HttpRule{
+				rule("grpc.testing.TestService.UnaryCall", "/v1/username", "username"),
+			}},
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := get(t, "/v1/username"), `"larking"`; got != want {
+			t.Fatalf("got %s, want %s", got, want)
+		}
+	})
+	t.Run("streaming", func(t *testing.T) {
+		if err := m.SetServiceConfig(&serviceconfig.Service{
+			Http: &annotations.Http{Rules: []*annotations.HttpRule{
+				{
+					Selector:     "grpc.testing.TestService.StreamingOutputCall",
+					Pattern:      &annotations.HttpRule_Post{Post: "/v1/stream"},
+					Body:         "*",
+					ResponseBody: "payload",
+				},
+			}},
+		}); err != nil {
+			t.Fatal(err)
+		}
+		body := do(t, http.MethodPost, "/v1/stream", `{"responseParameters":[{"size":1},{"size":2}]}`)
+
+		var got []*grpc_testing.Payload
+		dec := json.NewDecoder(strings.NewReader(body))
+		for dec.More() {
+			var raw json.RawMessage
+			if err := dec.Decode(&raw); err != nil {
+				t.Fatal(err)
+			}
+			p := &grpc_testing.Payload{}
+			if err := protojson.Unmarshal(raw, p); err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, p)
+		}
+		want := []*grpc_testing.Payload{
+			{Body: []byte("a")},
+			{Body: []byte("aa")},
+		}
+		if diff := cmp.Diff(want, got, protocmp.Transform()); diff != "" {
+			t.Fatal(diff)
+		}
+	})
+	t.Run("invalid", func(t *testing.T) {
+		for _, responseBody := range []string{"missing", "payload.missing"} {
+			err := m.SetServiceConfig(&serviceconfig.Service{
+				Http: &annotations.Http{Rules: []*annotations.HttpRule{
+					rule("grpc.testing.TestService.UnaryCall", "/v1/invalid", responseBody),
+				}},
+			})
+			if err == nil {
+				t.Fatalf("expected error for response body %q", responseBody)
+			}
+		}
+	})
+}
@@ -0,0 +1,385 @@
+// Copyright 2024 Edward McFarlane. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package larking
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// Multiplexed websocket frame types.
+const (
+	muxFrameOpen      = "open"      // client: start a stream calling method
+	muxFrameMessage   = "message"   // client and server: stream message
+	muxFrameHalfClose = "halfclose" // client: end of the client stream
+	muxFrameClose     = "close"     // client: cancel the stream
+	muxFrameHeader    = "header"    // server: response headers
+	muxFrameTrailer   = "trailer"   // server: response trailers and status
+)
+
+// muxFrame is a JSON text frame of a multiplexed websocket. Messages are
+// protobuf JSON, status is a JSON google.rpc.Status.
+type muxFrame struct {
+	ID       uint64              `json:"id"`
+	Type     string              `json:"type"`
+	Method   string              `json:"method,omitempty"`
+	Metadata map[string][]string `json:"metadata,omitempty"`
+	Message  json.RawMessage     `json:"message,omitempty"`
+	Status   json.RawMessage     `json:"status,omitempty"`
+}
+
+// WebsocketMuxOption serves a multiplexed websocket on path. Clients call
+// many methods over one connection, each as a stream with a client chosen
+// ID. Streams are opened with the method name and request metadata, then
+// send messages and half-close. The server replies with headers, messages
+// and trailers with the status. Frames are JSON text messages.
+func WebsocketMuxOption(path string) MuxOption {
+	return func(opts *muxOptions) { opts.websocketMuxPath = path }
+}
+
+func (m *Mux) isWebsocketMuxRequest(r *http.Request) bool {
+	p := m.opts.websocketMuxPath
+	return p != "" && r.URL.Path == p && isWebsocketRequest(r)
+}
+
+// websocketMux is a websocket connection of multiplexed streams.
+type websocketMux struct {
+	m     *Mux
+	r     *http.Request
+	conn  net.Conn
+	codec Codec
+
+	wmu    sync.Mutex // guards writes
+	closed bool
+
+	mu      sync.Mutex
+	streams map[uint64]*streamMux
+	wg      sync.WaitGroup
+}
+
+// writeFrame writes the frame, dropped once the connection is closing.
+func (c *websocketMux) writeFrame(f *muxFrame) error {
+	b, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.closed {
+		return io.ErrClosedPipe
+	}
+	return wsutil.WriteServerText(c.conn, b)
+}
+
+func (c *websocketMux) getStream(id uint64) *streamMux {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.streams[id]
+}
+
+// open starts the stream handler, stream errors are sent as the status.
+// Opening a stream twice aborts the open stream.
+func (c *websocketMux) open(ctx context.Context, f *muxFrame) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if stream, ok := c.streams[f.ID]; ok {
+		stream.cancel(status.Errorf(codes.InvalidArgument, "stream %d already open", f.ID))
+		return
+	}
+
+	// Stream metadata extends the connection headers.
+	hdr := c.r.Header.Clone()
+	for k, vs := range f.Metadata {
+		hdr[http.CanonicalHeaderKey(k)] = vs
+	}
+	ctx, md := newIncomingContext(ctx, hdr)
+
+	// Streams are cancelled with the cause of the error.
+	ctx, cancel := context.WithCancelCause(ctx)
+	var serr error
+	if v := hdr.Get("grpc-timeout"); v != "" {
+		if to, err := decodeTimeout(v); err != nil {
+			serr = status.Errorf(codes.InvalidArgument, "malformed grpc-timeout: %v", err)
+		} else {
+			var stop context.CancelFunc
+			ctx, stop = context.WithTimeout(ctx, to)
+			cancelCause := cancel
+			cancel = func(err error) { cancelCause(err); stop() }
+		}
+	}
+
+	stream := &streamMux{
+		ctx:    ctx,
+		cancel: cancel,
+		id:     f.ID,
+		method: f.Method,
+		conn:   c,
+		recv:   make(chan []byte, muxStreamBuffer),
+	}
+	c.streams[f.ID] = stream
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		herr := serr
+		if herr == nil {
+			herr = c.serveStream(stream, md)
+		}
+		if err := stream.cause(); err != nil {
+			herr = err
+		}
+		stream.finish(herr) //nolint
+
+		c.mu.Lock()
+		delete(c.streams, stream.id)
+		c.mu.Unlock()
+		stream.cancel(nil)
+	}()
+}
+
+func (c *websocketMux) serveStream(stream *streamMux, md metadata.MD) error {
+	s := c.m.loadState()
+	hd, err := s.pickMethodHandler(c.m.opts.picker, stream.method, md)
+	if err != nil {
+		return err
+	}
+	return hd.serve(&c.m.opts, stream)
+}
+
+// serve reads frames until the connection closes, cancelling open streams.
+func (c *websocketMux) serve(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer func() {
+		c.wmu.Lock()
+		c.closed = true
+		c.wmu.Unlock()
+		cancel()
+		c.wg.Wait()
+	}()
+
+	for {
+		b, err := readWebsocketData(c.conn, c.m.opts.maxReceiveMessageSize)
+		if err != nil {
+			return err
+		}
+		var f muxFrame
+		if err := json.Unmarshal(b, &f); err != nil {
+			return status.Errorf(codes.InvalidArgument, "invalid frame: %v", err)
+		}
+
+		switch f.Type {
+		case muxFrameOpen:
+			c.open(ctx, &f)
+		case muxFrameMessage:
+			// Frames for finished streams are dropped. Streams
+			// that fall behind are aborted, never blocking the
+			// connection.
+			stream := c.getStream(f.ID)
+			if stream == nil || stream.halfClosed {
+				continue
+			}
+			select {
+			case stream.recv <- f.Message:
+			default:
+				stream.cancel(status.Errorf(codes.ResourceExhausted,
+					"stream %d receive buffer full", f.ID))
+			}
+		case muxFrameHalfClose:
+			stream := c.getStream(f.ID)
+			if stream == nil || stream.halfClosed {
+				continue
+			}
+			stream.halfClosed = true
+			close(stream.recv)
+		case muxFrameClose:
+			if stream := c.getStream(f.ID); stream != nil {
+				stream.cancel(nil)
+			}
+		default:
+			// Invalid frames of open streams only abort the stream.
+			err := status.Errorf(codes.InvalidArgument, "invalid frame type %q", f.Type)
+			if stream := c.getStream(f.ID); stream != nil {
+				stream.cancel(err)
+				continue
+			}
+			return err
+		}
+	}
+}
+
+// serveWebsocketMux serves the multiplexed websocket.
+func (m *Mux) serveWebsocketMux(w http.ResponseWriter, r *http.Request) {
+	conn, _, _, err := ws.UpgradeHTTP(r, w)
+	if err != nil {
+		return // response written by upgrader
+	}
+	defer conn.Close()
+
+	codec, ok := m.opts.codecs["application/json"]
+	if !ok {
+		codec = CodecJSON{}
+	}
+	c := &websocketMux{
+		m:       m,
+		r:       r,
+		conn:    conn,
+		codec:   codec,
+		streams: make(map[uint64]*streamMux),
+	}
+	err = c.serve(r.Context())
+
+	var closed wsutil.ClosedError
+	if errors.As(err, &closed) {
+		return // client closed
+	}
+	st, _ := status.FromError(err)
+	code := ws.StatusNormalClosure
+	if st.Code() != codes.OK && st.Code() != codes.Unknown {
+		code = m.opts.wsStatusCode("", st)
+	}
+	f := ws.NewCloseFrame(ws.NewCloseFrameBody(code, st.Message()))
+	conn.Write(ws.MustCompileFrame(f)) //nolint
+}
+
+// muxStreamBuffer is the number of received messages buffered per stream.
+const muxStreamBuffer = 32
+
+// streamMux is a stream of a multiplexed websocket.
+type streamMux struct {
+	ctx        context.Context
+	cancel     context.CancelCauseFunc
+	id         uint64
+	method     string
+	conn       *websocketMux
+	recv       chan []byte
+	halfClosed bool // owned by the reader
+	header     metadata.MD
+	trailer    metadata.MD
+	sentHeader bool
+}
+
+func (s *streamMux) SetHeader(md metadata.MD) error {
+	if !s.sentHeader {
+		s.header = metadata.Join(s.header, md)
+	}
+	return nil
+}
+
+func (s *streamMux) SendHeader(md metadata.MD) error {
+	if s.sentHeader {
+		return nil // already sent?
+	}
+	s.header = metadata.Join(s.header, md)
+	s.sentHeader = true
+	return s.conn.writeFrame(&muxFrame{
+		ID:       s.id,
+		Type:     muxFrameHeader,
+		Metadata: muxMetadata(s.header),
+	})
+}
+
+func (s *streamMux) SetTrailer(md metadata.MD) {
+	s.trailer = metadata.Join(s.trailer, md)
+}
+
+func (s *streamMux) Context() context.Context {
+	sts := &serverTransportStream{s, s.method}
+	return grpc.NewContextWithServerTransportStream(s.ctx, sts)
+}
+
+func (s *streamMux) SendMsg(v interface{}) error {
+	opts := &s.conn.m.opts
+	b, err := s.conn.codec.MarshalAppend(nil, v)
+	if err != nil {
+		return status.Errorf(codes.Internal, "%s: error while marshaling: %v", s.conn.codec.Name(), err)
+	}
+	if len(b) > opts.maxSendMessageSize {
+		return status.Errorf(codes.ResourceExhausted, "websocket: sent message larger than max (%d vs. %d)", len(b), opts.maxSendMessageSize)
+	}
+	if err := s.SendHeader(nil); err != nil {
+		return err
+	}
+	return s.conn.writeFrame(&muxFrame{
+		ID:      s.id,
+		Type:    muxFrameMessage,
+		Message: b,
+	})
+}
+
+func (s *streamMux) RecvMsg(m interface{}) error {
+	select {
+	case b, ok := <-s.recv:
+		if !ok {
+			return io.EOF
+		}
+		if err := s.conn.codec.Unmarshal(b, m); err != nil {
+			return status.Errorf(codes.Internal, "%s: error while unmarshaling: %v", s.conn.codec.Name(), err)
+		}
+		return nil
+	case <-s.ctx.Done():
+		if err := s.cause(); err != nil {
+			return err
+		}
+		return status.FromContextError(s.ctx.Err()).Err()
+	}
+}
+
+// cause returns the status the stream was aborted with, if any.
+func (s *streamMux) cause() error {
+	err := context.Cause(s.ctx)
+	if _, ok := status.FromError(err); ok && err != nil {
+		return err
+	}
+	return nil
+}
+
+// finish sends the headers, if unsent, and the trailers with the status.
+func (s *streamMux) finish(err error) error {
+	if err := s.SendHeader(nil); err != nil {
+		return err
+	}
+	st, _ := status.FromError(err)
+	return s.writeTrailer(st)
+}
+
+func (s *streamMux) writeTrailer(st *status.Status) error {
+	b, err := protojson.Marshal(st.Proto())
+	if err != nil {
+		return err
+	}
+	return s.conn.writeFrame(&muxFrame{
+		ID:       s.id,
+		Type:     muxFrameTrailer,
+		Metadata: muxMetadata(s.trailer),
+		Status:   b,
+	})
+}
+
+// muxMetadata converts outgoing metadata to lower case header values.
+func muxMetadata(md metadata.MD) map[string][]string {
+	if len(md) == 0 {
+		return nil
+	}
+	hdr := make(http.Header, len(md))
+	setOutgoingHeader(hdr, md)
+	dst := make(map[string][]string, len(hdr))
+	for k, vs := range hdr {
+		dst[strings.ToLower(k)] = vs
+	}
+	return dst
+}
@@ -0,0 +1,277 @@
+// Copyright 2024 Edward McFarlane. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package larking
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+	"google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc/codes"
+	grpc_testing "google.golang.org/grpc/interop/grpc_testing"
+	grpcstatus "google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"larking.io/api/testpb"
+)
+
+func TestWebsocketMux(t *testing.T) {
+	mux, err := NewMux(WebsocketMuxOption("/ws"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	grpc_testing.RegisterTestServiceServer(mux, &connectServer{})
+	mux.RegisterService(&testpb.ChatRoom_ServiceDesc, chatRoomServer{})
+
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	conn, _, _, err := ws.Dial(testContext(t), "ws"+strings.TrimPrefix(ts.URL, "http")+"/ws")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	send := func(frames ...string) {
+		for _, f := range frames {
+			if err := wsutil.WriteClientText(conn, []byte(f)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	send(
+		`{"id":1,"type":"open","method":"/grpc.testing.TestService/UnaryCall"}`,
+		`{"id":2,"type":"open","method":"/grpc.testing.TestService/StreamingOutputCall","metadata":{"x-test":["stream"]}}`,
+		`{"id":3,"type":"open","method":"/larking.testpb.ChatRoom/Chat"}`,
+		`{"id":4,"type":"open","method":"/grpc.testing.TestService/Missing"}`,
+		`{"id":1,"type":"message","message":{"payload":{"body":"aGk="}}}`,
+		`{"id":2,"type":"message","message":{"responseParameters":[{"size":1},{"size":2}]}}`,
+		`{"id":2,"type":"halfclose"}`,
+		`{"id":3,"type":"message","message":{"text":"hello"}}`,
+		`{"id":3,"type":"message","message":{"text":"bye"}}`,
+	)
+
+	frames := make(map[uint64][]muxFrame)
+	for done := 0; done < 4; {
+		b, _, err := wsutil.ReadServerData(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var f muxFrame
+		if err := json.Unmarshal(b, &f); err != nil {
+			t.Fatal(err)
+		}
+		frames[f.ID] = append(frames[f.ID], f)
+		if f.Type == muxFrameTrailer {
+			done++
+		}
+	}
+
+	types := func(fs []muxFrame) string {
+		var s []string
+		for _, f := range fs {
+			s = append(s, f.Type)
+		}
+		return strings.Join(s, ",")
+	}
+	code := func(t *testing.T, f muxFrame) codes.Code {
+		t.Helper()
+		st := &status.Status{}
+		if err := protojson.Unmarshal(f.Status, st); err != nil {
+			t.Fatal(err)
+		}
+		return codes.Code(st.Code)
+	}
+
+	t.Run("unary", func(t *testing.T) {
+		fs := frames[1]
+		if got := types(fs); got != "header,message,trailer" {
+			t.Fatalf("got frames %s", got)
+		}
+		if got := fs[0].Metadata["x-header"]; len(got) != 1 || got[0] != "header" {
+			t.Errorf("got header %v", fs[0].Metadata)
+		}
+		resp := &grpc_testing.SimpleResponse{}
+		if err := protojson.Unmarshal(fs[1].Message, resp); err != nil {
+			t.Fatal(err)
+		}
+		if string(resp.Payload.GetBody()) != "hi" || resp.Username != "larking" {
+			t.Errorf("unexpected response %v", resp)
+		}
+		if got := fs[2].Metadata["x-trailer"]; len(got) != 1 || got[0] != "trailer" {
+			t.Errorf("got trailer %v", fs[2].Metadata)
+		}
+		if c := code(t, fs[2]); c != codes.OK {
+			t.Errorf("got code %v", c)
+		}
+	})
+	t.Run("serverStream", func(t *testing.T) {
+		fs := frames[2]
+		if got := types(fs); got != "header,message,message,trailer" {
+			t.Fatalf("got frames %s", got)
+		}
+		if c := code(t, fs[3]); c != codes.OK {
+			t.Errorf("got code %v", c)
+		}
+	})
+	t.Run("bidiStream", func(t *testing.T) {
+		fs := frames[3]
+		if got := types(fs); got != "header,message,trailer" {
+			t.Fatalf("got frames %s", got)
+		}
+		msg := &testpb.ChatMessage{}
+		if err := protojson.Unmarshal(fs[1].Message, msg); err != nil {
+			t.Fatal(err)
+		}
+		if msg.Text != "echo: hello" {
+			t.Errorf("got text %q", msg.Text)
+		}
+	})
+	t.Run("unimplemented", func(t *testing.T) {
+		fs := frames[4]
+		if got := types(fs); got != "header,trailer" {
+			t.Fatalf("got frames %s", got)
+		}
+		if c := code(t, fs[1]); c != codes.Unimplemented {
+			t.Errorf("got code %v", c)
+		}
+	})
+	t.Run("invalid", func(t *testing.T) {
+		send(
+			`{"id":6,"type":"open","method":"/larking.testpb.ChatRoom/Chat"}`,
+			`{"id":6,"type":"open","method":"/larking.testpb.ChatRoom/Chat"}`,
+			`{"id":7,"type":"open","method":"/larking.testpb.ChatRoom/Chat"}`,
+			`{"id":7,"type":"unknown"}`,
+			`{"id":8,"type":"open","method":"/grpc.testing.TestService/UnaryCall"}`,
+			`{"id":8,"type":"message","message":{}}`,
+		)
+		got := make(map[uint64]codes.Code)
+		for len(got) < 3 {
+			b, _, err := wsutil.ReadServerData(conn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var f muxFrame
+			if err := json.Unmarshal(b, &f); err != nil {
+				t.Fatal(err)
+			}
+			if f.Type == muxFrameTrailer {
+				got[f.ID] = code(t, f)
+			}
+		}
+		want := map[uint64]codes.Code{
+			6: codes.InvalidArgument,
+			7: codes.InvalidArgument,
+			8: codes.OK,
+		}
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Fatalf("got codes %v, want %v", got, want)
+		}
+	})
+	t.Run("cancel", func(t *testing.T) {
+		send(
+			`{"id":5,"type":"open","method":"/larking.testpb.ChatRoom/Chat"}`,
+			`{"id":5,"type":"close"}`,
+		)
+		for {
+			b, _, err := wsutil.ReadServerData(conn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var f muxFrame
+			if err := json.Unmarshal(b, &f); err != nil {
+				t.Fatal(err)
+			}
+			if f.ID != 5 || f.Type != muxFrameTrailer {
+				continue
+			}
+			if c := code(t, f); c != codes.Canceled {
+				t.Errorf("got code %v", c)
+			}
+			return
+		}
+	})
+}
+
+// stuckStreamServer never reads the requests of full duplex calls.
+type stuckStreamServer struct {
+	responseBodyServer
+}
+
+func (s *stuckStreamServer) FullDuplexCall(stream grpc_testing.TestService_FullDuplexCallServer) error {
+	<-stream.Context().Done()
+	return grpcstatus.FromContextError(stream.Context().Err()).Err()
+}
+
+func TestWebsocketMuxStuckStream(t *testing.T) {
+	mux, err := NewMux(WebsocketMuxOption("/ws"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	grpc_testing.RegisterTestServiceServer(mux, &stuckStreamServer{})
+
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	conn, _, _, err := ws.Dial(testContext(t), "ws"+strings.TrimPrefix(ts.URL, "http")+"/ws")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	send := func(frames ...string) {
+		for _, f := range frames {
+			if err := wsutil.WriteClientText(conn, []byte(f)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	send(
+		`{"id":1,"type":"open","method":"/grpc.testing.TestService/FullDuplexCall"}`,
+		`{"id":2,"type":"open","method":"/grpc.testing.TestService/FullDuplexCall"}`,
+	)
+	// Overflow the buffer of stream 1, stream 2 is blocked on a message.
+	for i := 0; i <= muxStreamBuffer; i++ {
+		send(`{"id":1,"type":"message","message":{}}`)
+	}
+	send(
+		`{"id":2,"type":"message","message":{}}`,
+		`{"id":3,"type":"open","method":"/grpc.testing.TestService/UnaryCall"}`,
+		`{"id":3,"type":"message","message":{}}`,
+		`{"id":2,"type":"close"}`,
+	)
+
+	got := make(map[uint64]codes.Code)
+	for len(got) < 3 {
+		b, _, err := wsutil.ReadServerData(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var f muxFrame
+		if err := json.Unmarshal(b, &f); err != nil {
+			t.Fatal(err)
+		}
+		if f.Type != muxFrameTrailer {
+			continue
+		}
+		st := &status.Status{}
+		if err := protojson.Unmarshal(f.Status, st); err != nil {
+			t.Fatal(err)
+		}
+		got[f.ID] = codes.Code(st.Code)
+	}
+	want := map[uint64]codes.Code{
+		1: codes.ResourceExhausted,
+		2: codes.Canceled,
+		3: codes.OK,
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("got codes %v, want %v", got, want)
+	}
+}
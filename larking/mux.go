@@ -8,10 +8,10 @@ import (
 	"bytes"
 	"context"
 	"crypto/sha256"
+	"errors"
 	"fmt"
 	"io"
 	"math"
-	"math/rand"
 	"net/http"
 	"sort"
 	"strings"
@@ -24,8 +24,12 @@ import (
 	"google.golang.org/genproto/googleapis/api/serviceconfig"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/grpclog"
 	"google.golang.org/grpc/metadata"
-	rpb "google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
+	rpb "google.golang.org/grpc/reflection/grpc_reflection_v1"
+	rpbalpha "google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
 	"google.golang.org/grpc/stats"
 	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/proto"
@@ -43,17 +47,20 @@ type connList struct {
 }
 
 type state struct {
-	path     *path
-	conns    map[*grpc.ClientConn]connList
-	handlers map[string][]*handler
+	path      *path
+	conns     map[*grpc.ClientConn]connList
+	handlers  map[string][]*handler
+	unhealthy map[*grpc.ClientConn]bool
+	httprules ruleSelector // RO
 }
 
 func (s *state) clone() *state {
 	if s == nil {
 		return &state{
-			path:     newPath(),
-			conns:    make(map[*grpc.ClientConn]connList),
-			handlers: make(map[string][]*handler),
+			path:      newPath(),
+			conns:     make(map[*grpc.ClientConn]connList),
+			handlers:  make(map[string][]*handler),
+			unhealthy: make(map[*grpc.ClientConn]bool),
 		}
 	}
 
@@ -67,10 +74,17 @@ func (s *state) clone() *state {
 		handlers[method] = hds
 	}
 
+	unhealthy := make(map[*grpc.ClientConn]bool)
+	for conn, v := range s.unhealthy {
+		unhealthy[conn] = v
+	}
+
 	return &state{
-		path:     s.path.clone(),
-		conns:    conns,
-		handlers: handlers,
+		path:      s.path.clone(),
+		conns:     conns,
+		handlers:  handlers,
+		unhealthy: unhealthy,
+		httprules: s.httprules,
 	}
 }
 
@@ -114,6 +128,19 @@ func (r *ruleSelector) getRules(name string) (rules []*annotations.HttpRule) {
 	return rules
 }
 
+// checkSelector validates the selector, wildcards are only allowed as the
+// last component.
+func checkSelector(selector string) error {
+	for name := selector; name != ""; {
+		var tag string
+		tag, name, _ = strings.Cut(name, ".")
+		if tag == "*" && name != "" {
+			return fmt.Errorf("invalid selector %q", selector)
+		}
+	}
+	return nil
+}
+
 func (r *ruleSelector) setRules(rules []*annotations.HttpRule) {
 	*r = ruleSelector{} // reset
 
@@ -163,6 +190,22 @@ type muxOptions struct {
 	maxReceiveMessageSize int
 	maxSendMessageSize    int
 	connectionTimeout     time.Duration
+	picker                Picker
+	healthCheck           bool
+	healthService         string
+	healthHook            func(cc *grpc.ClientConn, healthy bool)
+	refreshHook           func(cc *grpc.ClientConn, err error)
+	cors                  *CORSPolicy
+	eventStreamHeartbeat  time.Duration
+	websocketMuxPath      string
+	twirpErrorMeta        func(*status.Status, metadata.MD) map[string]string
+	twirpErrorTrailers    []string
+	googleErrorEnvelope   bool
+	errorEncoders         map[string]ErrorEncoder
+	errorContentOffers    []string
+	errorHandler          ErrorHandler
+	statusMapper          StatusMapper
+	err                   error // option error returned by NewMux
 }
 
 // readAll reads from r until an error or EOF and returns the data it read.
@@ -225,15 +268,20 @@ var (
 		maxReceiveMessageSize: defaultServerMaxReceiveMessageSize,
 		maxSendMessageSize:    defaultServerMaxSendMessageSize,
 		connectionTimeout:     defaultServerConnectionTimeout,
+		eventStreamHeartbeat:  defaultEventStreamHeartbeat,
+		twirpErrorMeta:        DefaultTwirpErrorMeta,
 		files:                 protoregistry.GlobalFiles,
 		types:                 protoregistry.GlobalTypes,
 	}
 
 	defaultCodecs = map[string]Codec{
 		"application/json":         CodecJSON{},
+		"application/x-ndjson":     CodecNDJSON{},
+		"application/jsonl":        CodecNDJSON{},
 		"application/protobuf":     CodecProto{},
 		"application/octet-stream": CodecProto{},
 		"google.api.HttpBody":      codecHTTPBody{},
+		eventStream:                CodecEventStream{},
 	}
 
 	defaultCompressors = map[string]Compressor{
@@ -250,6 +298,9 @@ func StreamServerInterceptorOption(interceptor grpc.StreamServerInterceptor) Mux
 	return func(opts *muxOptions) { opts.streamInterceptor = interceptor }
 }
 
+// StatsOption sets the stats handler of the mux. Messages of proxied native
+// gRPC calls are forwarded as raw frames, their payload stats have a nil
+// Payload and only report lengths.
 func StatsOption(h stats.Handler) MuxOption {
 	return func(opts *muxOptions) { opts.statsHandler = h }
 }
@@ -301,10 +352,22 @@ func ServiceConfigOption(sc *serviceconfig.Service) MuxOption {
 	}
 }
 
+// RefreshHookOption sets a hook called when the background refresh of the
+// services of a conn registered by RegisterConn fails. By default failures
+// are logged to grpclog.
+func RefreshHookOption(fn func(cc *grpc.ClientConn, err error)) MuxOption {
+	return func(opts *muxOptions) { opts.refreshHook = fn }
+}
+
+var logger = grpclog.Component("larking")
+
 type Mux struct {
-	opts  muxOptions
-	state atomic.Value
-	mu    sync.Mutex
+	opts     muxOptions
+	state    atomic.Value
+	mu       sync.Mutex
+	watchers map[*grpc.ClientConn]*connWatcher // guarded by mu
+
+	healthWatchers map[*grpc.ClientConn]*connWatcher // guarded by mu
 }
 
 func NewMux(opts ...MuxOption) (*Mux, error) {
@@ -313,6 +376,9 @@ func NewMux(opts ...MuxOption) (*Mux, error) {
 	for _, opt := range opts {
 		opt(&muxOpts)
 	}
+	if err := muxOpts.err; err != nil {
+		return nil, err
+	}
 
 	// Ensure codecs are set.
 	if muxOpts.codecs == nil {
@@ -331,6 +397,9 @@ func NewMux(opts ...MuxOption) (*Mux, error) {
 		muxOpts.contentTypeOffers = append(muxOpts.contentTypeOffers, k)
 	}
 	sort.Strings(muxOpts.contentTypeOffers)
+	muxOpts.errorContentOffers = errorContentTypeOffers(
+		muxOpts.contentTypeOffers, muxOpts.errorEncoders,
+	)
 
 	// Ensure compressors are set.
 	if muxOpts.compressors == nil {
@@ -346,17 +415,35 @@ func NewMux(opts ...MuxOption) (*Mux, error) {
 	}
 	sort.Strings(muxOpts.encodingTypeOffers)
 
-	return &Mux{
+	m := &Mux{
 		opts: muxOpts,
-	}, nil
+	}
+	s := m.loadState().clone()
+	s.httprules = muxOpts.httprules
+	m.storeState(s)
+	return m, nil
 }
 
+// RegisterConn registers the services of the gRPC server behind cc using
+// server reflection. A background watcher refreshes the services each time
+// the connection becomes ready again, swapping the handlers if the file
+// descriptors have changed. The watcher stops when ctx is done, cc is shutdown
+// or the conn is dropped.
 func (m *Mux) RegisterConn(ctx context.Context, cc *grpc.ClientConn) error {
-	c := rpb.NewServerReflectionClient(cc)
+	if err := m.syncConn(ctx, cc); err != nil {
+		return err
+	}
+	m.watchConn(ctx, cc)
+	m.watchHealth(ctx, cc)
+	return nil
+}
+
+// syncConn fetches the services of cc and updates the state.
+func (m *Mux) syncConn(ctx context.Context, cc *grpc.ClientConn) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
-	// TODO: watch the stream. When it is recreated refresh the service
-	// methods and recreate the mux if needed.
-	stream, err := c.ServerReflectionInfo(ctx, grpc.WaitForReady(true))
+	sds, fdHash, err := fetchConn(ctx, cc)
 	if err != nil {
 		return err
 	}
@@ -364,24 +451,295 @@ func (m *Mux) RegisterConn(ctx context.Context, cc *grpc.ClientConn) error {
 	// Load the state for writing.
 	m.mu.Lock()
 	defer m.mu.Unlock()
+	if err := ctx.Err(); err != nil {
+		return err // dropped whilst fetching
+	}
 	s := m.loadState().clone()
 
-	if err := s.addConnHandler(m.opts, cc, stream); err != nil {
+	if err := s.addConnHandler(cc, sds, fdHash); err != nil {
 		return err
 	}
 
 	m.storeState(s)
+	return nil
+}
 
-	return stream.CloseSend()
+type connWatcher struct {
+	cancel context.CancelFunc
 }
 
+// watchConn refreshes the services of cc on every transition to ready.
+// Only the latest watcher for each conn is kept running.
+func (m *Mux) watchConn(ctx context.Context, cc *grpc.ClientConn) {
+	ctx, cancel := context.WithCancel(ctx)
+	w := &connWatcher{cancel: cancel}
+
+	m.mu.Lock()
+	if prev, ok := m.watchers[cc]; ok {
+		prev.cancel()
+	}
+	if m.watchers == nil {
+		m.watchers = make(map[*grpc.ClientConn]*connWatcher)
+	}
+	m.watchers[cc] = w
+	m.mu.Unlock()
+
+	go func() {
+		defer func() {
+			m.mu.Lock()
+			if m.watchers[cc] == w {
+				delete(m.watchers, cc)
+			}
+			m.mu.Unlock()
+			cancel()
+		}()
+
+		last := cc.GetState()
+		for cc.WaitForStateChange(ctx, last) {
+			switch last = cc.GetState(); last {
+			case connectivity.Idle:
+				cc.Connect() // reconnect to detect changes
+			case connectivity.Ready:
+				if err := m.syncConn(ctx, cc); err != nil && ctx.Err() == nil {
+					if hook := m.opts.refreshHook; hook != nil {
+						hook(cc, err)
+					} else {
+						logger.Warningf("failed to refresh conn %s: %v", cc.Target(), err)
+					}
+				}
+			case connectivity.Shutdown:
+				m.mu.Lock()
+				if ctx.Err() == nil {
+					m.dropConn(cc)
+				}
+				m.mu.Unlock()
+				return
+			}
+		}
+	}()
+}
+
+// DropConn removes the handlers of cc and stops watching it for changes.
 func (m *Mux) DropConn(ctx context.Context, cc *grpc.ClientConn) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.dropConn(cc)
+}
+
+// dropConn must be called with m.mu held.
+func (m *Mux) dropConn(cc *grpc.ClientConn) bool {
+	if w, ok := m.watchers[cc]; ok {
+		w.cancel()
+		delete(m.watchers, cc)
+	}
+	if w, ok := m.healthWatchers[cc]; ok {
+		w.cancel()
+		delete(m.healthWatchers, cc)
+	}
+
+	// Load the state for writing.
+	s := m.loadState().clone()
+	if !s.removeHandler(cc) {
+		return false
+	}
+	delete(s.unhealthy, cc)
+	m.storeState(s)
+	return true
+}
+
+// SetServiceConfig replaces the service config of the mux, rebuilding the
+// HTTP rules of all registered methods. Invalid configs are rejected with
+// every error found and the mux is left unchanged.
+func (m *Mux) SetServiceConfig(sc *serviceconfig.Service) error {
+	rules := sc.GetHttp().GetRules()
+	var errs []error
+	for _, rule := range rules {
+		if err := checkSelector(rule.GetSelector()); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+	var httprules ruleSelector
+	httprules.setRules(rules)
+
+	// Load the state for writing.
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.loadState().clone()
+	s.httprules = httprules
+
+	if err := s.rebuildPath(); err != nil {
+		return err
+	}
+	m.storeState(s)
+	return nil
+}
+
+// RegisterConnWithFiles registers the services of the gRPC server behind cc
+// from static file descriptors, for servers without reflection enabled.
+// If services are given only those services are registered, otherwise every
+// service in files is. Any reflection watcher started by RegisterConn for cc
+// is stopped.
+func (m *Mux) RegisterConnWithFiles(ctx context.Context, cc *grpc.ClientConn, files *protoregistry.Files, services ...string) error {
+	sds, fdHash, err := filesServices(files, services)
+	if err != nil {
+		return err
+	}
+
+	if err := m.addConnFiles(ctx, cc, sds, fdHash); err != nil {
+		return err
+	}
+	m.watchHealth(ctx, cc)
+	return nil
+}
+
+// RegisterConnWithFileSet is RegisterConnWithFiles for a file descriptor
+// set, as produced by protoc --descriptor_set_out. Imports missing from the
+// set are resolved with FilesOption.
+func (m *Mux) RegisterConnWithFileSet(ctx context.Context, cc *grpc.ClientConn, set *descriptorpb.FileDescriptorSet, services ...string) error {
+	files, err := newFilesFromSet(set, m.opts.files)
+	if err != nil {
+		return err
+	}
+	return m.RegisterConnWithFiles(ctx, cc, files, services...)
+}
+
+// addConnFiles updates the state with the services of cc, stopping any
+// reflection watcher of cc.
+func (m *Mux) addConnFiles(ctx context.Context, cc *grpc.ClientConn, sds []protoreflect.ServiceDescriptor, fdHash []byte) error {
 	// Load the state for writing.
 	m.mu.Lock()
 	defer m.mu.Unlock()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if w, ok := m.watchers[cc]; ok {
+		w.cancel()
+		delete(m.watchers, cc)
+	}
 	s := m.loadState().clone()
 
-	return s.removeHandler(cc)
+	if err := s.addConnHandler(cc, sds, fdHash); err != nil {
+		return err
+	}
+
+	m.storeState(s)
+	return nil
+}
+
+// filesResolver implements protodesc.Resolver, preferring local files.
+type filesResolver struct {
+	local    *protoregistry.Files
+	fallback *protoregistry.Files
+}
+
+func (r filesResolver) FindFileByPath(path string) (protoreflect.FileDescriptor, error) {
+	if fd, err := r.local.FindFileByPath(path); err == nil {
+		return fd, nil
+	}
+	return r.fallback.FindFileByPath(path)
+}
+
+func (r filesResolver) FindDescriptorByName(fullname protoreflect.FullName) (protoreflect.Descriptor, error) {
+	if d, err := r.local.FindDescriptorByName(fullname); err == nil {
+		return d, nil
+	}
+	return r.fallback.FindDescriptorByName(fullname)
+}
+
+// newFilesFromSet creates the files of the set in dependency order.
+// Dependencies not in the set are resolved from fallback.
+func newFilesFromSet(set *descriptorpb.FileDescriptorSet, fallback *protoregistry.Files) (*protoregistry.Files, error) {
+	fdps := make(map[string]*descriptorpb.FileDescriptorProto)
+	for _, fdp := range set.GetFile() {
+		fdps[fdp.GetName()] = fdp
+	}
+
+	files := &protoregistry.Files{}
+	r := filesResolver{local: files, fallback: fallback}
+
+	var register func(name string) error
+	register = func(name string) error {
+		fdp, ok := fdps[name]
+		if !ok {
+			return nil // resolved from fallback
+		}
+		delete(fdps, name)
+
+		for _, dep := range fdp.GetDependency() {
+			if err := register(dep); err != nil {
+				return err
+			}
+		}
+		fd, err := protodesc.NewFile(fdp, r)
+		if err != nil {
+			return err
+		}
+		return files.RegisterFile(fd)
+	}
+	for _, fdp := range set.GetFile() {
+		if err := register(fdp.GetName()); err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+// filesServices resolves the named services from files, or every service if
+// names is empty. A hash of the service names and file descriptors is
+// returned to detect changes.
+func filesServices(files *protoregistry.Files, names []string) ([]protoreflect.ServiceDescriptor, []byte, error) {
+	names = append([]string(nil), names...)
+	if len(names) == 0 {
+		files.RangeFiles(func(fd protoreflect.FileDescriptor) bool {
+			sds := fd.Services()
+			for i := 0; i < sds.Len(); i++ {
+				names = append(names, string(sds.Get(i).FullName()))
+			}
+			return true
+		})
+	}
+	sort.Strings(names)
+
+	h := sha256.New()
+	for _, name := range names {
+		if _, err := io.WriteString(h, name+"\n"); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	sds := make([]protoreflect.ServiceDescriptor, 0, len(names))
+	seen := make(map[string]bool)
+	for _, name := range names {
+		d, err := files.FindDescriptorByName(protoreflect.FullName(name))
+		if err != nil {
+			return nil, nil, fmt.Errorf("service %s: %w", name, err)
+		}
+		sd, ok := d.(protoreflect.ServiceDescriptor)
+		if !ok {
+			return nil, nil, fmt.Errorf("invalid service descriptor %T", d)
+		}
+		sds = append(sds, sd)
+
+		fd := sd.ParentFile()
+		if seen[fd.Path()] {
+			continue
+		}
+		seen[fd.Path()] = true
+
+		b, err := proto.MarshalOptions{Deterministic: true}.Marshal(
+			protodesc.ToFileDescriptorProto(fd),
+		)
+		if err != nil {
+			return nil, nil, err
+		}
+		if _, err := h.Write(b); err != nil {
+			return nil, nil, err
+		}
+	}
+	return sds, h.Sum(nil), nil
 }
 
 // resolver implements protodesc.Resolver.
@@ -422,6 +780,9 @@ func (r *resolver) FindFileByPath(path string) (protoreflect.FileDescriptor, err
 	if err != nil {
 		return nil, err
 	}
+	if er := fdr.GetErrorResponse(); er != nil {
+		return nil, status.Error(codes.Code(er.GetErrorCode()), er.GetErrorMessage())
+	}
 	fdbs := fdr.GetFileDescriptorResponse().GetFileDescriptorProto()
 
 	var f protoreflect.FileDescriptor
@@ -431,14 +792,10 @@ func (r *resolver) FindFileByPath(path string) (protoreflect.FileDescriptor, err
 			return nil, err
 		}
 
-		file, err := protodesc.NewFile(fdp, r)
+		file, err := r.registerFile(fdp)
 		if err != nil {
 			return nil, err
 		}
-		// TODO: check duplicate file registry
-		if err := r.files.RegisterFile(file); err != nil {
-			return nil, err
-		}
 		if file.Path() == path {
 			f = file
 		}
@@ -449,47 +806,217 @@ func (r *resolver) FindFileByPath(path string) (protoreflect.FileDescriptor, err
 	return f, nil
 }
 
+// registerFile creates the file, resolving any missing dependencies, and
+// registers it. Files already registered are returned as is.
+func (r *resolver) registerFile(fdp *descriptorpb.FileDescriptorProto) (protoreflect.FileDescriptor, error) {
+	if fd, err := r.files.FindFileByPath(fdp.GetName()); err == nil {
+		return fd, nil // found file
+	}
+
+	file, err := protodesc.NewFile(fdp, r)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.files.RegisterFile(file); err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
 func (r *resolver) FindDescriptorByName(fullname protoreflect.FullName) (protoreflect.Descriptor, error) {
 	return r.files.FindDescriptorByName(fullname)
 }
 
+// fetchConn fetches the services of cc with server reflection, preferring
+// grpc.reflection.v1 and falling back to grpc.reflection.v1alpha.
+func fetchConn(ctx context.Context, cc *grpc.ClientConn) ([]protoreflect.ServiceDescriptor, []byte, error) {
+	stream, err := rpb.NewServerReflectionClient(cc).ServerReflectionInfo(ctx, grpc.WaitForReady(true))
+	if err != nil {
+		return nil, nil, err
+	}
+	sds, fdHash, err := fetchConnServices(stream)
+	if status.Code(err) == codes.Unimplemented {
+		alphaStream, alphaErr := rpbalpha.NewServerReflectionClient(cc).ServerReflectionInfo(ctx, grpc.WaitForReady(true))
+		if alphaErr != nil {
+			return nil, nil, alphaErr
+		}
+		stream = v1AlphaClientStream{alphaStream}
+		sds, fdHash, err = fetchConnServices(stream)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := stream.CloseSend(); err != nil {
+		return nil, nil, err
+	}
+	return sds, fdHash, nil
+}
+
+// fetchConnServices resolves every service listed by the server reflection
+// stream. A hash of the service names and raw file descriptors is returned to
+// detect changes.
+func fetchConnServices(stream rpb.ServerReflection_ServerReflectionInfoClient) ([]protoreflect.ServiceDescriptor, []byte, error) {
+	if err := stream.Send(&rpb.ServerReflectionRequest{
+		MessageRequest: &rpb.ServerReflectionRequest_ListServices{},
+	}); err != nil {
+		return nil, nil, err
+	}
+
+	r, err := stream.Recv()
+	if err != nil {
+		return nil, nil, err
+	}
+	if er := r.GetErrorResponse(); er != nil {
+		return nil, nil, status.Error(codes.Code(er.GetErrorCode()), er.GetErrorMessage())
+	}
+
+	// Sort services for a stable hash.
+	var names []string
+	for _, svc := range r.GetListServicesResponse().GetService() {
+		name := svc.GetName()
+		if strings.HasPrefix(name, "grpc.reflection.") {
+			continue // served by the mux, see RegisterReflectionServer
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// File descriptors hash for detecting updates.
+	h := sha256.New()
+	for _, name := range names {
+		if _, err := io.WriteString(h, name+"\n"); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	var fds []*descriptorpb.FileDescriptorProto
+	seen := make(map[string]bool)
+	for _, name := range names {
+		if err := stream.Send(&rpb.ServerReflectionRequest{
+			MessageRequest: &rpb.ServerReflectionRequest_FileContainingSymbol{
+				FileContainingSymbol: name,
+			},
+		}); err != nil {
+			return nil, nil, err
+		}
+
+		fdr, err := stream.Recv()
+		if err != nil {
+			return nil, nil, err
+		}
+		if er := fdr.GetErrorResponse(); er != nil {
+			return nil, nil, status.Error(codes.Code(er.GetErrorCode()), er.GetErrorMessage())
+		}
+
+		fdbb := fdr.GetFileDescriptorResponse().GetFileDescriptorProto()
+
+		for _, fdb := range fdbb {
+			fd := &descriptorpb.FileDescriptorProto{}
+			if err := proto.Unmarshal(fdb, fd); err != nil {
+				return nil, nil, err
+			}
+			if seen[fd.GetName()] {
+				continue
+			}
+			seen[fd.GetName()] = true
+			fds = append(fds, fd)
+
+			if _, err := h.Write(fdb); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+
+	rslvr, err := newResolver(stream)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, fd := range fds {
+		if _, err := rslvr.registerFile(fd); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	sds := make([]protoreflect.ServiceDescriptor, 0, len(names))
+	for _, name := range names {
+		d, err := rslvr.FindDescriptorByName(protoreflect.FullName(name))
+		if err != nil {
+			return nil, nil, err
+		}
+		sd, ok := d.(protoreflect.ServiceDescriptor)
+		if !ok {
+			return nil, nil, fmt.Errorf("invalid service descriptor %T", d)
+		}
+		sds = append(sds, sd)
+	}
+	return sds, h.Sum(nil), nil
+}
+
 func (s *state) appendHandler(
-	opts muxOptions,
 	desc protoreflect.MethodDescriptor,
 	h *handler,
 ) error {
+	if err := s.addRules(desc, h.method); err != nil {
+		return err
+	}
+	s.handlers[h.method] = append(s.handlers[h.method], h)
+	return nil
+}
+
+// addRules adds the implicit, ServiceConfig.http and annotated rules of the
+// method to the path.
+func (s *state) addRules(desc protoreflect.MethodDescriptor, name string) error {
 	// Add an implicit rule for the method.
 	implicitRule := &annotations.HttpRule{
 		Pattern: &annotations.HttpRule_Custom{
 			Custom: &annotations.CustomHttpPattern{
 				Kind: "*",
-				Path: h.method,
+				Path: name,
 			},
 		},
 		Body: "*",
 	}
-	if err := s.path.addRule(implicitRule, desc, h.method); err != nil {
-		panic(fmt.Sprintf("bug: %v", err))
+	if err := s.path.addRule(implicitRule, desc, name, RouteSourceImplicit); err != nil {
+		return fmt.Errorf("[%s] invalid implicit rule: %w", desc.FullName(), err)
 	}
 
 	// Add all ServiceConfig.http rules.
-	name := string(desc.FullName())
-	for _, rule := range opts.httprules.getRules(name) {
-		if err := s.path.addRule(rule, desc, h.method); err != nil {
+	for _, rule := range s.httprules.getRules(string(desc.FullName())) {
+		if err := s.path.addRule(rule, desc, name, RouteSourceServiceConfig); err != nil {
 			return fmt.Errorf("[%s] invalid ServiceConfig.http rule %s: %w", desc.FullName(), rule.String(), err)
 		}
 	}
 
 	// Add all annotated rules.
 	if rule := getExtensionHTTP(desc.Options()); rule != nil {
-		if err := s.path.addRule(rule, desc, h.method); err != nil {
+		if err := s.path.addRule(rule, desc, name, RouteSourceAnnotation); err != nil {
 			return fmt.Errorf("[%s] invalid rule %s: %w", desc.FullName(), rule.String(), err)
 		}
 	}
-	s.handlers[h.method] = append(s.handlers[h.method], h)
 	return nil
 }
 
+// rebuildPath recreates the path from the rules of every registered method.
+// All errors are returned.
+func (s *state) rebuildPath() error {
+	names := make([]string, 0, len(s.handlers))
+	for name := range s.handlers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	s.path = newPath()
+	var errs []error
+	for _, name := range names {
+		desc := s.handlers[name][0].desc
+		if err := s.addRules(desc, name); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
 func (s *state) removeHandler(cc *grpc.ClientConn) bool {
 	cl, ok := s.conns[cc]
 	if !ok {
@@ -520,59 +1047,10 @@ func (s *state) removeHandler(cc *grpc.ClientConn) bool {
 }
 
 func (s *state) addConnHandler(
-	opts muxOptions,
 	cc *grpc.ClientConn,
-	stream rpb.ServerReflection_ServerReflectionInfoClient,
+	sds []protoreflect.ServiceDescriptor,
+	fdHash []byte,
 ) error {
-	// TODO: async fetch and mux creation.
-
-	if err := stream.Send(&rpb.ServerReflectionRequest{
-		MessageRequest: &rpb.ServerReflectionRequest_ListServices{},
-	}); err != nil {
-		return err
-	}
-
-	r, err := stream.Recv()
-	if err != nil {
-		return err
-	}
-	// TODO: check r.GetErrorResponse()?
-
-	// File descriptors hash for detecting updates. TODO: sort fds?
-	h := sha256.New()
-
-	fds := make(map[string]*descriptorpb.FileDescriptorProto)
-	for _, svc := range r.GetListServicesResponse().GetService() {
-		if err := stream.Send(&rpb.ServerReflectionRequest{
-			MessageRequest: &rpb.ServerReflectionRequest_FileContainingSymbol{
-				FileContainingSymbol: svc.GetName(),
-			},
-		}); err != nil {
-			return err
-		}
-
-		fdr, err := stream.Recv()
-		if err != nil {
-			return err
-		}
-
-		fdbb := fdr.GetFileDescriptorResponse().GetFileDescriptorProto()
-
-		for _, fdb := range fdbb {
-			fd := &descriptorpb.FileDescriptorProto{}
-			if err := proto.Unmarshal(fdb, fd); err != nil {
-				return err
-			}
-			fds[fd.GetName()] = fd
-
-			if _, err := h.Write(fdb); err != nil {
-				return err
-			}
-		}
-	}
-
-	fdHash := h.Sum(nil)
-
 	// Check if previous connection exists.
 	if cl, ok := s.conns[cc]; ok {
 		if bytes.Equal(cl.fdHash, fdHash) {
@@ -583,19 +1061,9 @@ func (s *state) addConnHandler(
 		s.removeHandler(cc)
 	}
 
-	rslvr, err := newResolver(stream)
-	if err != nil {
-		return err
-	}
-
 	var handlers []*handler
-	for _, fd := range fds {
-		file, err := protodesc.NewFile(fd, rslvr)
-		if err != nil {
-			return err
-		}
-
-		hs, err := s.processFile(opts, cc, file)
+	for _, sd := range sds {
+		hs, err := s.processService(cc, sd)
 		if err != nil {
 			return err
 		}
@@ -637,16 +1105,26 @@ func createConnHandler(
 		fn := func(_ interface{}, stream grpc.ServerStream) error {
 			ctx := stream.Context()
 
-			args := dynamicpb.NewMessage(argsDesc)
+			// Forward raw frames if no transcoding is needed.
+			newArgs, newReply := newDynamic(argsDesc), newDynamic(replyDesc)
+			if isFrameStream(stream) {
+				newArgs, newReply = newFrame, newFrame
+			}
+
+			args := newArgs()
 			if err := stream.RecvMsg(args); err != nil {
 				return err
 			}
+			var callOpts []grpc.CallOption
+			if f, ok := args.(*frame); ok {
+				callOpts = frameCallOptions(f)
+			}
 
 			if md, ok := metadata.FromIncomingContext(ctx); ok {
 				ctx = metadata.NewOutgoingContext(ctx, md)
 			}
 
-			clientStream, err := cc.NewStream(ctx, sd, method)
+			clientStream, err := cc.NewStream(ctx, sd, method, callOpts...)
 			if err != nil {
 				return err
 			}
@@ -660,7 +1138,7 @@ func createConnHandler(
 				wg.Add(1)
 				go func() {
 					for {
-						args := dynamicpb.NewMessage(argsDesc)
+						args := newArgs()
 						if inErr = stream.RecvMsg(args); inErr != nil {
 							break
 						}
@@ -674,7 +1152,7 @@ func createConnHandler(
 			}
 			var outErr error
 			for {
-				reply := dynamicpb.NewMessage(replyDesc)
+				reply := newReply()
 				if outErr = clientStream.RecvMsg(reply); outErr != nil {
 					break
 				}
@@ -710,6 +1188,7 @@ func createConnHandler(
 			method:  method,
 			desc:    md,
 			handler: h,
+			conn:    cc,
 		}
 	} else {
 		info := &grpc.UnaryServerInfo{
@@ -717,20 +1196,34 @@ func createConnHandler(
 			FullMethod: method,
 		}
 		fn := func(ctx context.Context, args interface{}) (interface{}, error) {
-			reply := dynamicpb.NewMessage(replyDesc)
+			var reply interface{}
+			var callOpts []grpc.CallOption
+			if f, ok := args.(*frame); ok {
+				reply = newFrame()
+				callOpts = frameCallOptions(f)
+			} else {
+				reply = dynamicpb.NewMessage(replyDesc)
+			}
 
 			if md, ok := metadata.FromIncomingContext(ctx); ok {
 				ctx = metadata.NewOutgoingContext(ctx, md)
 			}
 
-			if err := cc.Invoke(ctx, method, args, reply); err != nil {
+			if err := cc.Invoke(ctx, method, args, reply, callOpts...); err != nil {
 				return nil, err
 			}
 			return reply, nil
 		}
 		h := func(opts *muxOptions, stream grpc.ServerStream) error {
 			ctx := stream.Context()
-			args := dynamicpb.NewMessage(argsDesc)
+
+			// Interceptors expect decoded messages.
+			var args interface{}
+			if opts.unaryInterceptor == nil && isFrameStream(stream) {
+				args = newFrame()
+			} else {
+				args = dynamicpb.NewMessage(argsDesc)
+			}
 
 			if err := stream.RecvMsg(args); err != nil {
 				return err
@@ -747,26 +1240,38 @@ func createConnHandler(
 			method:  method,
 			desc:    md,
 			handler: h,
+			conn:    cc,
 		}
 	}
 }
 
-func (s *state) processFile(opts muxOptions, cc *grpc.ClientConn, fd protoreflect.FileDescriptor) ([]*handler, error) {
-	var handlers []*handler
+// frameCallOptions forward raw frames to the upstream server. Compressed
+// frames are compressed upstream with the same encoding, if registered.
+func frameCallOptions(f *frame) []grpc.CallOption {
+	opts := []grpc.CallOption{grpc.ForceCodec(codecFrame{})}
+	if f.comp != nil && encoding.GetCompressor(f.comp.Name()) != nil {
+		opts = append(opts, grpc.UseCompressor(f.comp.Name()))
+	}
+	return opts
+}
 
-	sds := fd.Services()
-	for i := 0; i < sds.Len(); i++ {
-		sd := sds.Get(i)
+func newFrame() interface{} { return &frame{} }
 
-		mds := sd.Methods()
-		for j := 0; j < mds.Len(); j++ {
-			md := mds.Get(j)
-			hd := createConnHandler(cc, sd, md)
-			if err := s.appendHandler(opts, md, hd); err != nil {
-				return nil, err
-			}
-			handlers = append(handlers, hd)
+func newDynamic(desc protoreflect.MessageDescriptor) func() interface{} {
+	return func() interface{} { return dynamicpb.NewMessage(desc) }
+}
+
+func (s *state) processService(cc *grpc.ClientConn, sd protoreflect.ServiceDescriptor) ([]*handler, error) {
+	var handlers []*handler
+
+	mds := sd.Methods()
+	for j := 0; j < mds.Len(); j++ {
+		md := mds.Get(j)
+		hd := createConnHandler(cc, sd, md)
+		if err := s.appendHandler(md, hd); err != nil {
+			return nil, err
 		}
+		handlers = append(handlers, hd)
 	}
 	return handlers, nil
 }
@@ -777,12 +1282,14 @@ func (m *Mux) loadState() *state {
 }
 func (m *Mux) storeState(s *state) { m.state.Store(s) }
 
-func (s *state) pickMethodHandler(name string) (*handler, error) {
+func (s *state) pickMethodHandler(p Picker, name string, md metadata.MD) (*handler, error) {
 	if s != nil {
 		hds := s.handlers[name]
 		if len(hds) > 0 {
-			hd := hds[rand.Intn(len(hds))]
-			return hd, nil
+			if hds = s.healthyHandlers(hds); len(hds) == 0 {
+				return nil, status.Errorf(codes.Unavailable, "method %s has no healthy handlers", name)
+			}
+			return pick(p, name, md, hds)
 		}
 	}
 	return nil, status.Errorf(codes.Unimplemented, "method %s not implemented", name)
@@ -798,6 +1305,9 @@ func (s *state) match(route, verb string) (*method, params, error) {
 // ServeHTTP implements http.Handler.
 // It supports both gRPC and HTTP requests.
 func (m *Mux) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if m.serveCORS(w, r) {
+		return
+	}
 	if r.ProtoMajor == 2 && strings.HasPrefix(
 		r.Header.Get("Content-Type"), "application/grpc",
 	) {
@@ -811,12 +1321,24 @@ func (m *Mux) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		m.serveGRPCWeb(w, r)
 		return
 	}
+	if isWebsocketWebRequest(r) {
+		m.serveGRPCWebsocket(w, r)
+		return
+	}
+	if m.isWebsocketMuxRequest(r) {
+		m.serveWebsocketMux(w, r)
+		return
+	}
+	if enc, stream, ok := isConnectRequest(r); ok {
+		m.serveConnect(w, r, enc, stream)
+		return
+	}
 
 	if !strings.HasPrefix(r.URL.Path, "/") {
 		r.URL.Path = "/" + r.URL.Path
 	}
 	r.URL.Path = strings.TrimSuffix(r.URL.Path, "/")
 	if err := m.serveHTTP(w, r); err != nil {
-		m.encError(w, r, err)
+		m.encError(w, r, err, "", nil)
 	}
 }
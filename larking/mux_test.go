@@ -1,9 +1,26 @@
 package larking
 
 import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
 	"google.golang.org/genproto/googleapis/api/annotations"
+	"google.golang.org/genproto/googleapis/api/serviceconfig"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+
+	"larking.io/api/testpb"
+	"larking.io/health"
 )
 
 func TestRuleSelector(t *testing.T) {
@@ -58,3 +75,274 @@ func TestRuleSelector(t *testing.T) {
 		t.Fatalf("got %v, want %v", got, wildcardRule)
 	}
 }
+
+func TestRegisterConnWatch(t *testing.T) {
+	lis, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	addr := lis.Addr().String()
+
+	// First server only serves Messaging.
+	gs := grpc.NewServer()
+	testpb.RegisterMessagingServer(gs, &testpb.UnimplementedMessagingServer{})
+	reflection.Register(gs)
+	go gs.Serve(lis) //nolint
+
+	conn, err := grpc.Dial(addr,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatalf("cannot connect to server: %v", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mux, err := NewMux()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mux.RegisterConn(ctx, conn); err != nil {
+		t.Fatal(err)
+	}
+
+	const (
+		messagingMethod = "/larking.testpb.Messaging/GetMessageOne"
+		filesMethod     = "/larking.testpb.Files/UploadDownload"
+	)
+	hasMethod := func(name string) bool {
+		_, err := mux.loadState().pickMethodHandler(nil, name, nil)
+		return err == nil
+	}
+	if !hasMethod(messagingMethod) {
+		t.Fatalf("missing method %s", messagingMethod)
+	}
+
+	// Redeploy the server with only Files.
+	gs.Stop()
+	lis, err = net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	gs = grpc.NewServer()
+	testpb.RegisterFilesServer(gs, &testpb.UnimplementedFilesServer{})
+	reflection.Register(gs)
+	go gs.Serve(lis) //nolint
+	defer gs.Stop()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for !hasMethod(filesMethod) || hasMethod(messagingMethod) {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for conn refresh")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	// Routes follow the handlers.
+	if _, _, err := mux.loadState().match("/v1/messages/name/hello", http.MethodGet); err == nil {
+		t.Fatal("expected removed route")
+	}
+	if _, _, err := mux.loadState().match("/files/cat.jpg", http.MethodPost); err != nil {
+		t.Fatal(err)
+	}
+
+	if !mux.DropConn(ctx, conn) {
+		t.Fatal("expected conn to be dropped")
+	}
+	if hasMethod(filesMethod) {
+		t.Fatalf("expected method %s to be dropped", filesMethod)
+	}
+}
+
+func TestRegisterConnWithFiles(t *testing.T) {
+	// Server without reflection.
+	gs := grpc.NewServer()
+	testpb.RegisterMessagingServer(gs, &testpb.UnimplementedMessagingServer{})
+
+	lis, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer lis.Close()
+	go gs.Serve(lis) //nolint
+	defer gs.Stop()
+
+	conn, err := grpc.Dial(lis.Addr().String(),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatalf("cannot connect to server: %v", err)
+	}
+	defer conn.Close()
+
+	const (
+		messagingMethod = "/larking.testpb.Messaging/GetMessageOne"
+		filesMethod     = "/larking.testpb.Files/UploadDownload"
+	)
+
+	// Imports are resolved from the global registry.
+	set := &descriptorpb.FileDescriptorSet{
+		File: []*descriptorpb.FileDescriptorProto{
+			protodesc.ToFileDescriptorProto(testpb.File_larking_api_test_proto),
+		},
+	}
+
+	for _, tt := range []struct {
+		name     string
+		set      *descriptorpb.FileDescriptorSet
+		files    *protoregistry.Files
+		services []string
+		want     []string
+		wantNot  []string
+	}{{
+		name:     "set",
+		set:      set,
+		services: []string{"larking.testpb.Messaging"},
+		want:     []string{messagingMethod},
+		wantNot:  []string{filesMethod},
+	}, {
+		name: "setAll",
+		set:  set,
+		want: []string{messagingMethod, filesMethod},
+	}, {
+		name:     "registry",
+		files:    protoregistry.GlobalFiles,
+		services: []string{"larking.testpb.Files"},
+		want:     []string{filesMethod},
+		wantNot:  []string{messagingMethod},
+	}} {
+		t.Run(tt.name, func(t *testing.T) {
+			mux, err := NewMux()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.set != nil {
+				err = mux.RegisterConnWithFileSet(context.Background(), conn, tt.set, tt.services...)
+			} else {
+				err = mux.RegisterConnWithFiles(context.Background(), conn, tt.files, tt.services...)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			s := mux.loadState()
+			for _, name := range tt.want {
+				if _, err := s.pickMethodHandler(nil, name, nil); err != nil {
+					t.Fatalf("missing method %s: %v", name, err)
+				}
+			}
+			for _, name := range tt.wantNot {
+				if _, err := s.pickMethodHandler(nil, name, nil); err == nil {
+					t.Fatalf("unexpected method %s", name)
+				}
+			}
+		})
+	}
+
+	t.Run("proxy", func(t *testing.T) {
+		mux, err := NewMux()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := mux.RegisterConnWithFileSet(context.Background(), conn, set, "larking.testpb.Messaging"); err != nil {
+			t.Fatal(err)
+		}
+		r := httptest.NewRequest(http.MethodGet, "/v1/messages/hello", nil)
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		// Unimplemented by the backend, not the mux.
+		if w.Code != http.StatusNotImplemented {
+			t.Fatalf("got status %d: %s", w.Code, w.Body.String())
+		}
+		if !strings.Contains(w.Body.String(), "GetMessageTwo not implemented") {
+			t.Fatalf("unexpected body %s", w.Body.String())
+		}
+	})
+
+	t.Run("unknownService", func(t *testing.T) {
+		mux, err := NewMux()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := mux.RegisterConnWithFileSet(context.Background(), conn, set, "larking.testpb.Missing"); err == nil {
+			t.Fatal("expected error")
+		}
+	})
+}
+
+func TestSetServiceConfig(t *testing.T) {
+	serviceConfig := &serviceconfig.Service{}
+	health.AddHealthz(serviceConfig)
+
+	mux, err := NewMux(ServiceConfigOption(serviceConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs := health.NewServer()
+	defer hs.Shutdown()
+	mux.RegisterService(&healthpb.Health_ServiceDesc, hs)
+
+	get := func(path string) int {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		return w.Code
+	}
+	if code := get("/v1/healthz"); code != http.StatusOK {
+		t.Fatalf("got status %d", code)
+	}
+
+	if err := mux.SetServiceConfig(&serviceconfig.Service{
+		Http: &annotations.Http{Rules: []*annotations.HttpRule{{
+			Selector: "grpc.health.v1.Health.Check",
+			Pattern: &annotations.HttpRule_Get{
+				Get: "/healthcheck",
+			},
+		}}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if code := get("/healthcheck"); code != http.StatusOK {
+		t.Fatalf("got status %d", code)
+	}
+	if code := get("/v1/healthz"); code != http.StatusNotFound {
+		t.Fatalf("got status %d", code)
+	}
+
+	// Invalid configs are rejected with all errors.
+	err = mux.SetServiceConfig(&serviceconfig.Service{
+		Http: &annotations.Http{Rules: []*annotations.HttpRule{{
+			Selector: "grpc.health.v1.Health.Check",
+			Pattern: &annotations.HttpRule_Get{
+				Get: "/v1/{missing}",
+			},
+		}, {
+			Selector: "grpc.health.v1.Health.Watch",
+			Pattern: &annotations.HttpRule_Get{
+				Get: "/v1/{unknown}",
+			},
+		}}},
+	})
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	for _, want := range []string{"grpc.health.v1.Health.Check", "grpc.health.v1.Health.Watch"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("missing %s in error %v", want, err)
+		}
+	}
+	if err := mux.SetServiceConfig(&serviceconfig.Service{
+		Http: &annotations.Http{Rules: []*annotations.HttpRule{{
+			Selector: "grpc.*.Health",
+			Pattern: &annotations.HttpRule_Get{
+				Get: "/v1/health",
+			},
+		}}},
+	}); err == nil {
+		t.Fatal("expected selector error")
+	}
+	if code := get("/healthcheck"); code != http.StatusOK {
+		t.Fatalf("got status %d", code)
+	}
+}
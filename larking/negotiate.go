@@ -210,3 +210,33 @@ func negotiateContentType(header http.Header, offers []string, defaultOffer stri
 	}
 	return bestOffer
 }
+
+// negotiateLanguage returns the best offered language tag for the request's
+// Accept-Language header. Tags match if equal or one is a prefix of the other
+// ending at a subtag, so en matches en-US. If two offers match with equal
+// weight, then the offer earlier in the list is preferred. If no offers are
+// acceptable, then "" is returned.
+func negotiateLanguage(header http.Header, offers []string) string {
+	bestOffer := ""
+	bestQ := 0.0
+	specs := parseAccept(header["Accept-Language"])
+	for _, offer := range offers {
+		for _, spec := range specs {
+			if spec.Q > bestQ && matchLanguage(spec.Value, offer) {
+				bestQ = spec.Q
+				bestOffer = offer
+			}
+		}
+	}
+	return bestOffer
+}
+
+func matchLanguage(a, b string) bool {
+	if a == "*" {
+		return true
+	}
+	if len(a) > len(b) {
+		a, b = b, a
+	}
+	return strings.EqualFold(a, b[:len(a)]) && (len(a) == len(b) || b[len(a)] == '-')
+}
@@ -63,3 +63,29 @@ func TestNegotiateContentType(t *testing.T) {
 		}
 	}
 }
+
+var negotiateLanguageTests = []struct {
+	s      string
+	offers []string
+	expect string
+}{
+	{"en-US", []string{"fr", "en-US"}, "en-US"},
+	{"en", []string{"fr", "en-GB"}, "en-GB"},
+	{"en-US", []string{"fr", "en"}, "en"},
+	{"fr;q=0.9, de", []string{"fr-FR", "en"}, "fr-FR"},
+	{"fr;q=0.5, en;q=0.8", []string{"fr", "en"}, "en"},
+	{"*", []string{"fr", "en"}, "fr"},
+	{"de, *;q=0", []string{"fr"}, ""},
+	{"", []string{"fr"}, ""},
+	{"eng", []string{"en"}, ""},
+}
+
+func TestNegotiateLanguage(t *testing.T) {
+	for _, tt := range negotiateLanguageTests {
+		h := http.Header{"Accept-Language": {tt.s}}
+		actual := negotiateLanguage(h, tt.offers)
+		if actual != tt.expect {
+			t.Errorf("negotiateLanguage(%q, %#v)=%q, want %q", tt.s, tt.offers, actual, tt.expect)
+		}
+	}
+}
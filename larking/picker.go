@@ -0,0 +1,179 @@
+// Copyright 2024 Edward McFarlane. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package larking
+
+import (
+	"hash/fnv"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// PickInfo is the call information passed to a Picker.
+type PickInfo struct {
+	Method     string          // /{ServiceName}/{MethodName}
+	Metadata   metadata.MD     // incoming metadata of the call
+	Candidates []PickCandidate // handlers registered for the method
+}
+
+// PickCandidate is a handler registered for a method.
+type PickCandidate struct {
+	Conn        *grpc.ClientConn // nil for locally registered services
+	Outstanding int64            // calls currently in flight
+}
+
+// Picker picks the handler to serve a call when multiple conns or local
+// services register the same method. Pick returns the index of the chosen
+// candidate. Errors are returned to the caller and should be status errors.
+type Picker interface {
+	Pick(info *PickInfo) (int, error)
+}
+
+// PickerFunc is an adapter to allow the use of ordinary functions as Pickers.
+type PickerFunc func(info *PickInfo) (int, error)
+
+// Pick calls f(info).
+func (f PickerFunc) Pick(info *PickInfo) (int, error) { return f(info) }
+
+// PickerOption sets the picker used to load balance between handlers.
+// Defaults to RandomPicker.
+func PickerOption(p Picker) MuxOption {
+	return func(opts *muxOptions) { opts.picker = p }
+}
+
+// RandomPicker picks a candidate at random.
+func RandomPicker() Picker {
+	return PickerFunc(func(info *PickInfo) (int, error) {
+		return rand.Intn(len(info.Candidates)), nil
+	})
+}
+
+type roundRobinPicker struct {
+	next sync.Map // method -> *uint64
+}
+
+func (p *roundRobinPicker) Pick(info *PickInfo) (int, error) {
+	v, ok := p.next.Load(info.Method)
+	if !ok {
+		v, _ = p.next.LoadOrStore(info.Method, new(uint64))
+	}
+	n := atomic.AddUint64(v.(*uint64), 1) - 1
+	return int(n % uint64(len(info.Candidates))), nil
+}
+
+// RoundRobinPicker cycles through the candidates of each method in turn.
+func RoundRobinPicker() Picker {
+	return &roundRobinPicker{}
+}
+
+// LeastOutstandingPicker picks the candidate with the fewest calls in flight.
+// Ties are broken at random.
+func LeastOutstandingPicker() Picker {
+	return PickerFunc(func(info *PickInfo) (int, error) {
+		best, ties := 0, 0
+		for i, c := range info.Candidates {
+			switch least := info.Candidates[best].Outstanding; {
+			case c.Outstanding < least:
+				best, ties = i, 1
+			case c.Outstanding == least:
+				ties++
+				if rand.Intn(ties) == 0 {
+					best = i
+				}
+			}
+		}
+		return best, nil
+	})
+}
+
+// WeightedPicker picks candidates at random in proportion to the weight of
+// their conn. Conns missing from weights, and local services keyed by a nil
+// conn, have a weight of one.
+func WeightedPicker(weights map[*grpc.ClientConn]int) Picker {
+	weight := func(cc *grpc.ClientConn) int {
+		if w, ok := weights[cc]; ok {
+			return w
+		}
+		return 1
+	}
+	return PickerFunc(func(info *PickInfo) (int, error) {
+		var total int
+		for _, c := range info.Candidates {
+			if w := weight(c.Conn); w > 0 {
+				total += w
+			}
+		}
+		if total == 0 {
+			return rand.Intn(len(info.Candidates)), nil
+		}
+		n := rand.Intn(total)
+		for i, c := range info.Candidates {
+			w := weight(c.Conn)
+			if w <= 0 {
+				continue
+			}
+			if n < w {
+				return i, nil
+			}
+			n -= w
+		}
+		return len(info.Candidates) - 1, nil
+	})
+}
+
+// StickyPicker consistently picks the same candidate for each value of the
+// metadata key, such as a tenant header. Calls without the key are passed to
+// fallback, or picked at random if fallback is nil.
+func StickyPicker(key string, fallback Picker) Picker {
+	if fallback == nil {
+		fallback = RandomPicker()
+	}
+	return PickerFunc(func(info *PickInfo) (int, error) {
+		vs := info.Metadata.Get(key)
+		if len(vs) == 0 {
+			return fallback.Pick(info)
+		}
+		h := fnv.New32a()
+		for _, v := range vs {
+			h.Write([]byte(v)) //nolint
+		}
+		return int(h.Sum32() % uint32(len(info.Candidates))), nil
+	})
+}
+
+// pick calls the picker with the candidates of the method.
+func pick(p Picker, name string, md metadata.MD, hds []*handler) (*handler, error) {
+	if len(hds) == 1 {
+		return hds[0], nil
+	}
+	if p == nil {
+		return hds[rand.Intn(len(hds))], nil
+	}
+
+	candidates := make([]PickCandidate, len(hds))
+	for i, hd := range hds {
+		candidates[i] = PickCandidate{
+			Conn:        hd.conn,
+			Outstanding: hd.outstanding.Load(),
+		}
+	}
+	i, err := p.Pick(&PickInfo{
+		Method:     name,
+		Metadata:   md,
+		Candidates: candidates,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if i < 0 || i >= len(hds) {
+		return nil, status.Errorf(codes.Internal, "picker returned invalid index %d for %d candidates", i, len(hds))
+	}
+	return hds[i], nil
+}
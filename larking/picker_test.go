@@ -0,0 +1,158 @@
+// Copyright 2024 Edward McFarlane. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package larking
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"google.golang.org/genproto/googleapis/api/serviceconfig"
+	"google.golang.org/grpc"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/encoding/protojson"
+
+	"larking.io/health"
+)
+
+func TestPickers(t *testing.T) {
+	ccA, ccB := &grpc.ClientConn{}, &grpc.ClientConn{}
+	candidates := []PickCandidate{
+		{Conn: ccA, Outstanding: 3},
+		{Conn: ccB, Outstanding: 1},
+		{Conn: nil, Outstanding: 2},
+	}
+	newInfo := func(md metadata.MD) *PickInfo {
+		return &PickInfo{
+			Method:     "/larking.testpb.Messaging/GetMessageOne",
+			Metadata:   md,
+			Candidates: candidates,
+		}
+	}
+
+	t.Run("roundRobin", func(t *testing.T) {
+		p := RoundRobinPicker()
+		for i := 0; i < 6; i++ {
+			got, err := p.Pick(newInfo(nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := i % len(candidates); got != want {
+				t.Fatalf("pick %d got %d, want %d", i, got, want)
+			}
+		}
+	})
+	t.Run("leastOutstanding", func(t *testing.T) {
+		got, err := LeastOutstandingPicker().Pick(newInfo(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != 1 {
+			t.Fatalf("got %d, want 1", got)
+		}
+	})
+	t.Run("weighted", func(t *testing.T) {
+		p := WeightedPicker(map[*grpc.ClientConn]int{
+			ccA: 0, ccB: 1, nil: 0,
+		})
+		for i := 0; i < 10; i++ {
+			got, err := p.Pick(newInfo(nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != 1 {
+				t.Fatalf("got %d, want 1", got)
+			}
+		}
+	})
+	t.Run("sticky", func(t *testing.T) {
+		p := StickyPicker("x-tenant", PickerFunc(func(*PickInfo) (int, error) {
+			return 2, nil
+		}))
+		md := metadata.Pairs("x-tenant", "acme")
+		first, err := p.Pick(newInfo(md))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 10; i++ {
+			got, err := p.Pick(newInfo(md))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != first {
+				t.Fatalf("got %d, want %d", got, first)
+			}
+		}
+		got, err := p.Pick(newInfo(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != 2 {
+			t.Fatalf("fallback got %d, want 2", got)
+		}
+	})
+}
+
+func TestPickerOption(t *testing.T) {
+	serviceConfig := &serviceconfig.Service{}
+	health.AddHealthz(serviceConfig)
+
+	var calls []string
+	mux, err := NewMux(
+		ServiceConfigOption(serviceConfig),
+		PickerOption(PickerFunc(func(info *PickInfo) (int, error) {
+			calls = append(calls, info.Method)
+			if len(info.Metadata.Get("x-backend")) > 0 {
+				return 1, nil
+			}
+			return 0, nil
+		})),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Register two local health servers with different statuses.
+	up := health.NewServer()
+	defer up.Shutdown()
+	mux.RegisterService(&healthpb.Health_ServiceDesc, up)
+	down := health.NewServer()
+	defer down.Shutdown()
+	down.SetServingStatus("", healthpb.HealthCheckResponse_NOT_SERVING)
+	mux.RegisterService(&healthpb.Health_ServiceDesc, down)
+
+	for _, tt := range []struct {
+		name   string
+		header string
+		want   healthpb.HealthCheckResponse_ServingStatus
+	}{
+		{"first", "", healthpb.HealthCheckResponse_SERVING},
+		{"second", "b", healthpb.HealthCheckResponse_NOT_SERVING},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/v1/healthz", nil)
+			if tt.header != "" {
+				r.Header.Set("X-Backend", tt.header)
+			}
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, r)
+			if w.Code != http.StatusOK {
+				t.Fatalf("got status %d: %s", w.Code, w.Body.String())
+			}
+
+			var rsp healthpb.HealthCheckResponse
+			if err := protojson.Unmarshal(w.Body.Bytes(), &rsp); err != nil {
+				t.Fatal(err)
+			}
+			if rsp.Status != tt.want {
+				t.Fatalf("got %v, want %v", rsp.Status, tt.want)
+			}
+		})
+	}
+	if len(calls) != 2 || calls[0] != "/grpc.health.v1.Health/Check" {
+		t.Fatalf("unexpected picker calls %v", calls)
+	}
+}
@@ -5,108 +5,307 @@
 package larking
 
 import (
+	"fmt"
 	"io"
+	"sort"
 
 	"google.golang.org/grpc"
-	rpb "google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
+	"google.golang.org/grpc/codes"
+	rpb "google.golang.org/grpc/reflection/grpc_reflection_v1"
+	rpbalpha "google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
+	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/reflect/protodesc"
 	"google.golang.org/protobuf/reflect/protoreflect"
 	"google.golang.org/protobuf/reflect/protoregistry"
 )
 
-// TODO: fetch type on a per stream basis
 type serverReflectionServer struct {
 	rpb.UnimplementedServerReflectionServer
 	m *Mux
-	s *grpc.Server
+	s grpc.ServiceRegistrar
 }
 
 // RegisterReflectionServer registers the server reflection service for multiple
 // proxied gRPC servers. Each individual reflection stream is merged to provide
-// a consistent view at the point of stream creation.
-func (m *Mux) RegisterReflectionServer(s *grpc.Server) {
-	rpb.RegisterServerReflectionServer(s, &serverReflectionServer{
+// a consistent view at the point of stream creation. Both grpc.reflection.v1
+// and grpc.reflection.v1alpha are registered.
+//
+// The registrar may be the Mux itself to serve reflection alongside the
+// proxied services. If the registrar lists its own services, like
+// *grpc.Server, those are included in the view.
+func (m *Mux) RegisterReflectionServer(s grpc.ServiceRegistrar) {
+	svr := &serverReflectionServer{
 		m: m,
 		s: s,
-	})
+	}
+	rpb.RegisterServerReflectionServer(s, svr)
+	rpbalpha.RegisterServerReflectionServer(s, v1AlphaServer{svr: svr})
 }
 
-// does marshalling on it and returns the marshalled result.
-//
-//nolint:unused // fileDescEncodingByFilename finds the file descriptor for given filename,
-func (s *serverReflectionServer) fileDescEncodingByFilename(name string) ([]byte, error) {
-	fd, err := protoregistry.GlobalFiles.FindFileByPath(name)
+// convertReflection copies src to dst. The grpc.reflection.v1 and
+// grpc.reflection.v1alpha messages are wire compatible.
+func convertReflection(dst, src proto.Message) error {
+	b, err := proto.Marshal(src)
 	if err != nil {
+		return err
+	}
+	return proto.Unmarshal(b, dst)
+}
+
+// v1AlphaServer serves grpc.reflection.v1alpha with the v1 server.
+type v1AlphaServer struct {
+	rpbalpha.UnimplementedServerReflectionServer
+	svr rpb.ServerReflectionServer
+}
+
+func (s v1AlphaServer) ServerReflectionInfo(stream rpbalpha.ServerReflection_ServerReflectionInfoServer) error {
+	return s.svr.ServerReflectionInfo(v1AlphaServerStream{stream})
+}
+
+type v1AlphaServerStream struct {
+	rpbalpha.ServerReflection_ServerReflectionInfoServer
+}
+
+func (s v1AlphaServerStream) Send(rsp *rpb.ServerReflectionResponse) error {
+	out := &rpbalpha.ServerReflectionResponse{}
+	if err := convertReflection(out, rsp); err != nil {
+		return err
+	}
+	return s.ServerReflection_ServerReflectionInfoServer.Send(out)
+}
+
+func (s v1AlphaServerStream) Recv() (*rpb.ServerReflectionRequest, error) {
+	in, err := s.ServerReflection_ServerReflectionInfoServer.Recv()
+	if err != nil {
+		return nil, err
+	}
+	req := &rpb.ServerReflectionRequest{}
+	if err := convertReflection(req, in); err != nil {
 		return nil, err
 	}
-	return proto.Marshal(protodesc.ToFileDescriptorProto(fd))
+	return req, nil
 }
 
-// does marshalling on it and returns the marshalled result.
-// The given symbol can be a type, a service or a method.
-//
-//nolint:unused // fileDescEncodingContainingSymbol finds the file descriptor containing the given symbol,
-func (s *serverReflectionServer) fileDescEncodingContainingSymbol(name string) ([]byte, error) {
-	fullname := protoreflect.FullName(name)
-	d, err := protoregistry.GlobalFiles.FindDescriptorByName(fullname)
+// v1AlphaClientStream calls grpc.reflection.v1alpha with v1 messages.
+type v1AlphaClientStream struct {
+	rpbalpha.ServerReflection_ServerReflectionInfoClient
+}
+
+func (s v1AlphaClientStream) Send(req *rpb.ServerReflectionRequest) error {
+	out := &rpbalpha.ServerReflectionRequest{}
+	if err := convertReflection(out, req); err != nil {
+		return err
+	}
+	return s.ServerReflection_ServerReflectionInfoClient.Send(out)
+}
+
+func (s v1AlphaClientStream) Recv() (*rpb.ServerReflectionResponse, error) {
+	in, err := s.ServerReflection_ServerReflectionInfoClient.Recv()
 	if err != nil {
 		return nil, err
 	}
-	fd := d.ParentFile()
-	return proto.Marshal(protodesc.ToFileDescriptorProto(fd))
+	rsp := &rpb.ServerReflectionResponse{}
+	if err := convertReflection(rsp, in); err != nil {
+		return nil, err
+	}
+	return rsp, nil
+}
+
+// reflectionIndex is a snapshot of the files reachable from every service.
+type reflectionIndex struct {
+	services   []string
+	files      protoregistry.Files
+	extensions map[protoreflect.FullName]map[protoreflect.FieldNumber]protoreflect.FileDescriptor
+}
+
+// newIndex merges the local and proxied services of the mux.
+func (s *serverReflectionServer) newIndex() *reflectionIndex {
+	x := &reflectionIndex{
+		extensions: make(map[protoreflect.FullName]map[protoreflect.FieldNumber]protoreflect.FileDescriptor),
+	}
+
+	seen := make(map[protoreflect.FullName]bool)
+	addService := func(sd protoreflect.ServiceDescriptor) {
+		if seen[sd.FullName()] {
+			return
+		}
+		seen[sd.FullName()] = true
+		x.services = append(x.services, string(sd.FullName()))
+		x.addFile(sd.ParentFile())
+	}
+
+	if st := s.m.loadState(); st != nil {
+		for _, hds := range st.handlers {
+			for _, hd := range hds {
+				if sd, ok := hd.desc.Parent().(protoreflect.ServiceDescriptor); ok {
+					addService(sd)
+				}
+			}
+		}
+	}
+	if sp, ok := s.s.(interface {
+		GetServiceInfo() map[string]grpc.ServiceInfo
+	}); ok {
+		for name := range sp.GetServiceInfo() {
+			d, err := s.m.opts.files.FindDescriptorByName(protoreflect.FullName(name))
+			if err != nil {
+				continue
+			}
+			if sd, ok := d.(protoreflect.ServiceDescriptor); ok {
+				addService(sd)
+			}
+		}
+	}
+	sort.Strings(x.services)
+	return x
+}
+
+// addFile registers the file and its imports. The first file registered for
+// a path wins on conflicts.
+func (x *reflectionIndex) addFile(fd protoreflect.FileDescriptor) {
+	if fd.IsPlaceholder() {
+		return
+	}
+	if _, err := x.files.FindFileByPath(fd.Path()); err == nil {
+		return // already registered
+	}
+	if err := x.files.RegisterFile(fd); err != nil {
+		return // conflicting symbols
+	}
+
+	imports := fd.Imports()
+	for i := 0; i < imports.Len(); i++ {
+		x.addFile(imports.Get(i).FileDescriptor)
+	}
+
+	x.addExtensions(fd, fd.Extensions())
+	var addMessages func(mds protoreflect.MessageDescriptors)
+	addMessages = func(mds protoreflect.MessageDescriptors) {
+		for i := 0; i < mds.Len(); i++ {
+			md := mds.Get(i)
+			x.addExtensions(fd, md.Extensions())
+			addMessages(md.Messages())
+		}
+	}
+	addMessages(fd.Messages())
+}
+
+func (x *reflectionIndex) addExtensions(fd protoreflect.FileDescriptor, xds protoreflect.ExtensionDescriptors) {
+	for i := 0; i < xds.Len(); i++ {
+		xd := xds.Get(i)
+		name := xd.ContainingMessage().FullName()
+		nums := x.extensions[name]
+		if nums == nil {
+			nums = make(map[protoreflect.FieldNumber]protoreflect.FileDescriptor)
+			x.extensions[name] = nums
+		}
+		if _, ok := nums[xd.Number()]; !ok {
+			nums[xd.Number()] = fd
+		}
+	}
+}
+
+// fileDescEncoding marshals the file and any dependencies not yet sent on
+// the stream.
+func (x *reflectionIndex) fileDescEncoding(fd protoreflect.FileDescriptor, sent map[string]bool) ([][]byte, error) {
+	var out [][]byte
+	var encode func(fd protoreflect.FileDescriptor) error
+	encode = func(fd protoreflect.FileDescriptor) error {
+		b, err := proto.Marshal(protodesc.ToFileDescriptorProto(fd))
+		if err != nil {
+			return err
+		}
+		out = append(out, b)
+		sent[fd.Path()] = true
+
+		imports := fd.Imports()
+		for i := 0; i < imports.Len(); i++ {
+			dep := imports.Get(i).FileDescriptor
+			if dep.IsPlaceholder() || sent[dep.Path()] {
+				continue
+			}
+			if err := encode(dep); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := encode(fd); err != nil {
+		return nil, err
+	}
+	return out, nil
 }
 
+// fileDescEncodingByFilename finds the file descriptor for given filename,
 // does marshalling on it and returns the marshalled result.
-//
-//nolint:unused // fileDescEncodingContainingExtension finds the file descriptor containing given extension,
-func (s *serverReflectionServer) fileDescEncodingContainingExtension(typeName string, extNum int32) ([]byte, error) {
-	fullname := protoreflect.FullName(typeName)
-	fieldnumber := protoreflect.FieldNumber(extNum)
-	ext, err := protoregistry.GlobalTypes.FindExtensionByNumber(fullname, fieldnumber)
+func (x *reflectionIndex) fileDescEncodingByFilename(name string, sent map[string]bool) ([][]byte, error) {
+	fd, err := x.files.FindFileByPath(name)
 	if err != nil {
 		return nil, err
 	}
+	return x.fileDescEncoding(fd, sent)
+}
 
-	extd := ext.TypeDescriptor()
-	d, err := protoregistry.GlobalFiles.FindDescriptorByName(extd.FullName())
+// fileDescEncodingContainingSymbol finds the file descriptor containing the
+// given symbol, does marshalling on it and returns the marshalled result.
+// The given symbol can be a type, a service or a method.
+func (x *reflectionIndex) fileDescEncodingContainingSymbol(name string, sent map[string]bool) ([][]byte, error) {
+	d, err := x.files.FindDescriptorByName(protoreflect.FullName(name))
 	if err != nil {
 		return nil, err
 	}
-	fd := d.ParentFile()
+	return x.fileDescEncoding(d.ParentFile(), sent)
+}
 
-	return proto.Marshal(protodesc.ToFileDescriptorProto(fd))
+// fileDescEncodingContainingExtension finds the file descriptor containing
+// given extension, does marshalling on it and returns the marshalled result.
+func (x *reflectionIndex) fileDescEncodingContainingExtension(typeName string, extNum int32, sent map[string]bool) ([][]byte, error) {
+	fd, ok := x.extensions[protoreflect.FullName(typeName)][protoreflect.FieldNumber(extNum)]
+	if !ok {
+		return nil, fmt.Errorf("extension %d of %s not found", extNum, typeName)
+	}
+	return x.fileDescEncoding(fd, sent)
 }
 
-//nolint:unused // allExtensionNumbersForTypeName returns all extension numbers for the given type.
-func (s *serverReflectionServer) allExtensionNumbersForTypeName(name string) ([]int32, error) {
-	fullname := protoreflect.FullName(name)
-	_, err := protoregistry.GlobalFiles.FindDescriptorByName(fullname)
+// allExtensionNumbersForTypeName returns all extension numbers for the given type.
+func (x *reflectionIndex) allExtensionNumbersForTypeName(name string) ([]int32, error) {
+	d, err := x.files.FindDescriptorByName(protoreflect.FullName(name))
 	if err != nil {
 		return nil, err
 	}
+	if _, ok := d.(protoreflect.MessageDescriptor); !ok {
+		return nil, fmt.Errorf("%s is not a message", name)
+	}
 
-	n := protoregistry.GlobalTypes.NumExtensionsByMessage(fullname)
-	if n == 0 {
-		return nil, nil
+	nums := x.extensions[protoreflect.FullName(name)]
+	extNums := make([]int32, 0, len(nums))
+	for num := range nums {
+		extNums = append(extNums, int32(num))
 	}
+	sort.Slice(extNums, func(i, j int) bool { return extNums[i] < extNums[j] })
+	return extNums, nil
+}
 
-	extNums := make([]int32, 0, n)
-	protoregistry.GlobalTypes.RangeExtensionsByMessage(
-		fullname,
-		func(et protoreflect.ExtensionType) bool {
-			ed := et.TypeDescriptor().Descriptor()
-			extNums = append(extNums, int32(ed.Number()))
-			return true
+func errorResponse(err error) *rpb.ServerReflectionResponse_ErrorResponse {
+	return &rpb.ServerReflectionResponse_ErrorResponse{
+		ErrorResponse: &rpb.ErrorResponse{
+			ErrorCode:    int32(codes.NotFound),
+			ErrorMessage: err.Error(),
 		},
-	)
-	return extNums, nil
+	}
+}
+
+func fileDescriptorResponse(b [][]byte) *rpb.ServerReflectionResponse_FileDescriptorResponse {
+	return &rpb.ServerReflectionResponse_FileDescriptorResponse{
+		FileDescriptorResponse: &rpb.FileDescriptorResponse{FileDescriptorProto: b},
+	}
 }
 
 // ServerReflectionInfo is the reflection service handler.
 func (s *serverReflectionServer) ServerReflectionInfo(stream rpb.ServerReflection_ServerReflectionInfoServer) error {
-
-	//ss := s.m.loadState()
+	x := s.newIndex()
+	sent := make(map[string]bool)
 
 	for {
 		in, err := stream.Recv()
@@ -121,60 +320,34 @@ func (s *serverReflectionServer) ServerReflectionInfo(stream rpb.ServerReflectio
 			ValidHost:       in.Host,
 			OriginalRequest: in,
 		}
-		/*switch req := in.MessageRequest.(type) {
+		switch req := in.MessageRequest.(type) {
 		case *rpb.ServerReflectionRequest_FileByFilename:
-			b, err := s.fileDescEncodingByFilename(req.FileByFilename)
+			b, err := x.fileDescEncodingByFilename(req.FileByFilename, sent)
 			if err != nil {
-				out.MessageResponse = &rpb.ServerReflectionResponse_ErrorResponse{
-					ErrorResponse: &rpb.ErrorResponse{
-						ErrorCode:    int32(codes.NotFound),
-						ErrorMessage: err.Error(),
-					},
-				}
+				out.MessageResponse = errorResponse(err)
 			} else {
-				out.MessageResponse = &rpb.ServerReflectionResponse_FileDescriptorResponse{
-					FileDescriptorResponse: &rpb.FileDescriptorResponse{FileDescriptorProto: [][]byte{b}},
-				}
+				out.MessageResponse = fileDescriptorResponse(b)
 			}
 		case *rpb.ServerReflectionRequest_FileContainingSymbol:
-			b, err := s.fileDescEncodingContainingSymbol(req.FileContainingSymbol)
+			b, err := x.fileDescEncodingContainingSymbol(req.FileContainingSymbol, sent)
 			if err != nil {
-				out.MessageResponse = &rpb.ServerReflectionResponse_ErrorResponse{
-					ErrorResponse: &rpb.ErrorResponse{
-						ErrorCode:    int32(codes.NotFound),
-						ErrorMessage: err.Error(),
-					},
-				}
+				out.MessageResponse = errorResponse(err)
 			} else {
-				out.MessageResponse = &rpb.ServerReflectionResponse_FileDescriptorResponse{
-					FileDescriptorResponse: &rpb.FileDescriptorResponse{FileDescriptorProto: [][]byte{b}},
-				}
+				out.MessageResponse = fileDescriptorResponse(b)
 			}
 		case *rpb.ServerReflectionRequest_FileContainingExtension:
 			typeName := req.FileContainingExtension.ContainingType
 			extNum := req.FileContainingExtension.ExtensionNumber
-			b, err := s.fileDescEncodingContainingExtension(typeName, extNum)
+			b, err := x.fileDescEncodingContainingExtension(typeName, extNum, sent)
 			if err != nil {
-				out.MessageResponse = &rpb.ServerReflectionResponse_ErrorResponse{
-					ErrorResponse: &rpb.ErrorResponse{
-						ErrorCode:    int32(codes.NotFound),
-						ErrorMessage: err.Error(),
-					},
-				}
+				out.MessageResponse = errorResponse(err)
 			} else {
-				out.MessageResponse = &rpb.ServerReflectionResponse_FileDescriptorResponse{
-					FileDescriptorResponse: &rpb.FileDescriptorResponse{FileDescriptorProto: [][]byte{b}},
-				}
+				out.MessageResponse = fileDescriptorResponse(b)
 			}
 		case *rpb.ServerReflectionRequest_AllExtensionNumbersOfType:
-			extNums, err := s.allExtensionNumbersForTypeName(req.AllExtensionNumbersOfType)
+			extNums, err := x.allExtensionNumbersForTypeName(req.AllExtensionNumbersOfType)
 			if err != nil {
-				out.MessageResponse = &rpb.ServerReflectionResponse_ErrorResponse{
-					ErrorResponse: &rpb.ErrorResponse{
-						ErrorCode:    int32(codes.NotFound),
-						ErrorMessage: err.Error(),
-					},
-				}
+				out.MessageResponse = errorResponse(err)
 			} else {
 				out.MessageResponse = &rpb.ServerReflectionResponse_AllExtensionNumbersResponse{
 					AllExtensionNumbersResponse: &rpb.ExtensionNumberResponse{
@@ -184,16 +357,12 @@ func (s *serverReflectionServer) ServerReflectionInfo(stream rpb.ServerReflectio
 				}
 			}
 		case *rpb.ServerReflectionRequest_ListServices:
-			svcInfo := s.s.GetServiceInfo()
-			serviceResponses := make([]*rpb.ServiceResponse, 0, len(svcInfo))
-			for svcName := range svcInfo {
+			serviceResponses := make([]*rpb.ServiceResponse, 0, len(x.services))
+			for _, name := range x.services {
 				serviceResponses = append(serviceResponses, &rpb.ServiceResponse{
-					Name: svcName,
+					Name: name,
 				})
 			}
-			sort.Slice(serviceResponses, func(i, j int) bool {
-				return serviceResponses[i].Name < serviceResponses[j].Name
-			})
 			out.MessageResponse = &rpb.ServerReflectionResponse_ListServicesResponse{
 				ListServicesResponse: &rpb.ListServiceResponse{
 					Service: serviceResponses,
@@ -201,7 +370,7 @@ func (s *serverReflectionServer) ServerReflectionInfo(stream rpb.ServerReflectio
 			}
 		default:
 			return status.Errorf(codes.InvalidArgument, "invalid MessageRequest: %v", in.MessageRequest)
-		}*/
+		}
 
 		if err := stream.Send(out); err != nil {
 			return err
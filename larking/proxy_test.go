@@ -8,19 +8,28 @@ import (
 	"context"
 	"net"
 	"net/http"
+	"sync"
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
 	"google.golang.org/genproto/googleapis/api/httpbody"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/encoding"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/reflection"
+	rpb "google.golang.org/grpc/reflection/grpc_reflection_v1"
+	rpbalpha "google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
+	"google.golang.org/grpc/stats"
 	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/testing/protocmp"
+	"google.golang.org/protobuf/types/descriptorpb"
 
 	"golang.org/x/sync/errgroup"
 	"larking.io/api/testpb"
+	"larking.io/health"
 )
 
 func TestGRPCProxy(t *testing.T) {
@@ -29,7 +38,8 @@ func TestGRPCProxy(t *testing.T) {
 	fs := &testpb.UnimplementedFilesServer{}
 
 	o := &overrides{}
-	gs := grpc.NewServer(o.streamOption(), o.unaryOption())
+	us := &payloadStats{} // upstream
+	gs := grpc.NewServer(o.streamOption(), o.unaryOption(), grpc.StatsHandler(us))
 	testpb.RegisterMessagingServer(gs, ms)
 	testpb.RegisterFilesServer(gs, fs)
 	reflection.Register(gs)
@@ -64,7 +74,9 @@ func TestGRPCProxy(t *testing.T) {
 	}
 	defer conn.Close()
 
-	h, err := NewMux()
+	encoding.RegisterCompressor(&CompressorGzip{})
+	ps := &payloadStats{}
+	h, err := NewMux(StatsOption(ps))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -107,7 +119,10 @@ func TestGRPCProxy(t *testing.T) {
 		name   string
 		desc   *grpc.StreamDesc
 		method string
+		opts   []grpc.CallOption
 		inouts []interface{}
+		// upstream message encoding
+		compression string
 	}{{
 		name:   "unary_message",
 		desc:   unaryStreamDesc,
@@ -117,6 +132,17 @@ func TestGRPCProxy(t *testing.T) {
 		}, out{
 			msg: &testpb.Message{Text: "success"},
 		}},
+	}, {
+		name:   "unary_message_gzip",
+		desc:   unaryStreamDesc,
+		method: "/larking.testpb.Messaging/GetMessageOne",
+		opts:   []grpc.CallOption{grpc.UseCompressor("gzip")},
+		inouts: []interface{}{in{
+			msg: &testpb.GetMessageRequestOne{Name: "proxy"},
+		}, out{
+			msg: &testpb.Message{Text: "success"},
+		}},
+		compression: "gzip",
 	}, {
 		name: "stream_file",
 		desc: &grpc.StreamDesc{
@@ -153,11 +179,13 @@ func TestGRPCProxy(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			o.reset(t, "test", tt.inouts)
+			ps.reset()
+			us.reset()
 
 			ctx := context.Background()
 			ctx = metadata.AppendToOutgoingContext(ctx, "test", tt.method)
 
-			s, err := cc.NewStream(ctx, tt.desc, tt.method)
+			s, err := cc.NewStream(ctx, tt.desc, tt.method, tt.opts...)
 			if err != nil {
 				t.Fatal(err)
 			}
@@ -179,6 +207,316 @@ func TestGRPCProxy(t *testing.T) {
 					}
 				}
 			}
+
+			// Messages are forwarded without decoding, stats only
+			// report lengths.
+			payloads, _ := ps.get()
+			if len(payloads) == 0 {
+				t.Error("missing payload stats")
+			}
+			for _, p := range payloads {
+				if p != nil {
+					t.Errorf("unexpected payload %T", p)
+				}
+			}
+			if _, compression := us.get(); compression != tt.compression {
+				t.Errorf("got upstream compression %q, want %q", compression, tt.compression)
+			}
+		})
+	}
+}
+
+// payloadStats records the payloads and the message encoding of a server.
+type payloadStats struct {
+	mu          sync.Mutex
+	payloads    []interface{}
+	compression string
+}
+
+func (s *payloadStats) TagRPC(ctx context.Context, _ *stats.RPCTagInfo) context.Context {
+	return ctx
+}
+func (s *payloadStats) HandleRPC(_ context.Context, rs stats.RPCStats) {
+	var p interface{}
+	switch rs := rs.(type) {
+	case *stats.InPayload:
+		p = rs.Payload
+	case *stats.OutPayload:
+		p = rs.Payload
+	case *stats.InHeader:
+		s.mu.Lock()
+		s.compression = rs.Compression
+		s.mu.Unlock()
+		return
+	default:
+		return
+	}
+	s.mu.Lock()
+	s.payloads = append(s.payloads, p)
+	s.mu.Unlock()
+}
+func (s *payloadStats) TagConn(ctx context.Context, _ *stats.ConnTagInfo) context.Context {
+	return ctx
+}
+func (s *payloadStats) HandleConn(context.Context, stats.ConnStats) {}
+
+func (s *payloadStats) reset() {
+	s.mu.Lock()
+	s.payloads = nil
+	s.compression = ""
+	s.mu.Unlock()
+}
+func (s *payloadStats) get() ([]interface{}, string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]interface{}(nil), s.payloads...), s.compression
+}
+
+func TestReflectionServer(t *testing.T) {
+	// Create test server.
+	gs := grpc.NewServer()
+	testpb.RegisterMessagingServer(gs, &testpb.UnimplementedMessagingServer{})
+	reflection.Register(gs)
+
+	lis, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer lis.Close()
+
+	var g errgroup.Group
+	defer func() {
+		if err := g.Wait(); err != nil && err != http.ErrServerClosed {
+			t.Fatal(err)
+		}
+	}()
+	g.Go(func() error {
+		return gs.Serve(lis)
+	})
+	defer gs.Stop()
+
+	conn, err := grpc.Dial(
+		lis.Addr().String(),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatalf("cannot connect to server: %v", err)
+	}
+	defer conn.Close()
+
+	// Mux serves a local health service, the proxied messaging service and
+	// the merged reflection.
+	h, err := NewMux()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.RegisterConn(context.Background(), conn); err != nil {
+		t.Fatal(err)
+	}
+	hs := health.NewServer()
+	defer hs.Shutdown()
+	h.RegisterService(&healthpb.Health_ServiceDesc, hs)
+	h.RegisterReflectionServer(h)
+
+	lisProxy, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer lisProxy.Close()
+
+	ts, err := NewServer(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.Go(func() error {
+		return ts.Serve(lisProxy)
+	})
+	defer ts.Close()
+
+	cc, err := grpc.Dial(
+		lisProxy.Addr().String(),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+
+	stream, err := rpb.NewServerReflectionClient(cc).ServerReflectionInfo(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.CloseSend() //nolint
+
+	call := func(req *rpb.ServerReflectionRequest) *rpb.ServerReflectionResponse {
+		t.Helper()
+		if err := stream.Send(req); err != nil {
+			t.Fatal(err)
+		}
+		rsp, err := stream.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rsp
+	}
+	fileNames := func(rsp *rpb.ServerReflectionResponse) []string {
+		t.Helper()
+		var names []string
+		for _, b := range rsp.GetFileDescriptorResponse().GetFileDescriptorProto() {
+			fdp := &descriptorpb.FileDescriptorProto{}
+			if err := proto.Unmarshal(b, fdp); err != nil {
+				t.Fatal(err)
+			}
+			names = append(names, fdp.GetName())
+		}
+		return names
+	}
+
+	t.Run("ListServices", func(t *testing.T) {
+		rsp := call(&rpb.ServerReflectionRequest{
+			MessageRequest: &rpb.ServerReflectionRequest_ListServices{},
+		})
+		var got []string
+		for _, svc := range rsp.GetListServicesResponse().GetService() {
+			got = append(got, svc.GetName())
+		}
+		want := []string{
+			"grpc.health.v1.Health",
+			"grpc.reflection.v1.ServerReflection",
+			"grpc.reflection.v1alpha.ServerReflection",
+			"larking.testpb.Messaging",
+		}
+		if diff := cmp.Diff(got, want); diff != "" {
+			t.Fatal(diff)
+		}
+	})
+	t.Run("ListServicesV1Alpha", func(t *testing.T) {
+		stream, err := rpbalpha.NewServerReflectionClient(cc).ServerReflectionInfo(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer stream.CloseSend() //nolint
+
+		if err := stream.Send(&rpbalpha.ServerReflectionRequest{
+			MessageRequest: &rpbalpha.ServerReflectionRequest_ListServices{},
+		}); err != nil {
+			t.Fatal(err)
+		}
+		rsp, err := stream.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := len(rsp.GetListServicesResponse().GetService()); n != 4 {
+			t.Fatalf("expected 4 services, got %d", n)
+		}
+	})
+	t.Run("FileContainingSymbol", func(t *testing.T) {
+		rsp := call(&rpb.ServerReflectionRequest{
+			MessageRequest: &rpb.ServerReflectionRequest_FileContainingSymbol{
+				FileContainingSymbol: "larking.testpb.Messaging.GetMessageOne",
+			},
+		})
+		names := fileNames(rsp)
+		if len(names) < 2 || names[0] != "larking/api/test.proto" {
+			t.Fatalf("unexpected files %v", names)
+		}
+	})
+	t.Run("FileByFilename", func(t *testing.T) {
+		rsp := call(&rpb.ServerReflectionRequest{
+			MessageRequest: &rpb.ServerReflectionRequest_FileByFilename{
+				FileByFilename: "grpc/health/v1/health.proto",
+			},
+		})
+		if names := fileNames(rsp); len(names) != 1 || names[0] != "grpc/health/v1/health.proto" {
+			t.Fatalf("unexpected files %v", names)
+		}
+	})
+	t.Run("FileContainingExtension", func(t *testing.T) {
+		rsp := call(&rpb.ServerReflectionRequest{
+			MessageRequest: &rpb.ServerReflectionRequest_FileContainingExtension{
+				FileContainingExtension: &rpb.ExtensionRequest{
+					ContainingType:  "google.protobuf.MethodOptions",
+					ExtensionNumber: 72295728,
+				},
+			},
+		})
+		// Already sent with api/test.proto, only the file is returned.
+		if names := fileNames(rsp); len(names) != 1 || names[0] != "google/api/annotations.proto" {
+			t.Fatalf("unexpected files %v", names)
+		}
+	})
+	t.Run("AllExtensionNumbersOfType", func(t *testing.T) {
+		rsp := call(&rpb.ServerReflectionRequest{
+			MessageRequest: &rpb.ServerReflectionRequest_AllExtensionNumbersOfType{
+				AllExtensionNumbersOfType: "google.protobuf.MethodOptions",
+			},
+		})
+		got := rsp.GetAllExtensionNumbersResponse().GetExtensionNumber()
+		if diff := cmp.Diff(got, []int32{72295728}); diff != "" {
+			t.Fatal(diff)
+		}
+	})
+	t.Run("NotFound", func(t *testing.T) {
+		rsp := call(&rpb.ServerReflectionRequest{
+			MessageRequest: &rpb.ServerReflectionRequest_FileContainingSymbol{
+				FileContainingSymbol: "larking.testpb.Missing",
+			},
+		})
+		if code := rsp.GetErrorResponse().GetErrorCode(); code != int32(codes.NotFound) {
+			t.Fatalf("expected not found, got %d", code)
+		}
+	})
+}
+
+func TestRegisterConnReflectionVersions(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		register func(gs *grpc.Server)
+	}{{
+		name: "v1",
+		register: func(gs *grpc.Server) {
+			reflection.RegisterV1(gs)
+		},
+	}, {
+		name: "v1alpha",
+		register: func(gs *grpc.Server) {
+			rpbalpha.RegisterServerReflectionServer(gs, reflection.NewServer(
+				reflection.ServerOptions{Services: gs},
+			))
+		},
+	}} {
+		t.Run(tt.name, func(t *testing.T) {
+			gs := grpc.NewServer()
+			testpb.RegisterMessagingServer(gs, &testpb.UnimplementedMessagingServer{})
+			tt.register(gs)
+
+			lis, err := net.Listen("tcp", "localhost:0")
+			if err != nil {
+				t.Fatalf("failed to listen: %v", err)
+			}
+			defer lis.Close()
+			go gs.Serve(lis) //nolint
+			defer gs.Stop()
+
+			conn, err := grpc.Dial(
+				lis.Addr().String(),
+				grpc.WithTransportCredentials(insecure.NewCredentials()),
+			)
+			if err != nil {
+				t.Fatalf("cannot connect to server: %v", err)
+			}
+			defer conn.Close()
+
+			h, err := NewMux()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := h.RegisterConn(context.Background(), conn); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := h.loadState().pickMethodHandler(nil, "/larking.testpb.Messaging/GetMessageOne", nil); err != nil {
+				t.Fatal(err)
+			}
 		})
 	}
 }
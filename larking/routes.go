@@ -0,0 +1,189 @@
+// Copyright 2024 Edward McFarlane. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package larking
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"sort"
+
+	"google.golang.org/grpc"
+)
+
+// RouteSource is the origin of the HTTP rule of a route.
+type RouteSource int
+
+const (
+	// RouteSourceImplicit is the implicit /{ServiceName}/{MethodName} route.
+	RouteSourceImplicit RouteSource = iota
+	// RouteSourceAnnotation is a google.api.http method option.
+	RouteSourceAnnotation
+	// RouteSourceServiceConfig is a ServiceConfig.http rule.
+	RouteSourceServiceConfig
+)
+
+func (s RouteSource) String() string {
+	switch s {
+	case RouteSourceImplicit:
+		return "implicit"
+	case RouteSourceAnnotation:
+		return "annotation"
+	case RouteSourceServiceConfig:
+		return "service_config"
+	default:
+		return "unknown"
+	}
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (s RouteSource) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (s *RouteSource) UnmarshalText(b []byte) error {
+	for _, v := range []RouteSource{
+		RouteSourceImplicit, RouteSourceAnnotation, RouteSourceServiceConfig,
+	} {
+		if v.String() == string(b) {
+			*s = v
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid route source %q", b)
+}
+
+// Route is a HTTP binding of a gRPC method.
+type Route struct {
+	Verb         string             // HTTP method, "*" matches any method
+	Template     string             // path template
+	Method       string             // /{ServiceName}/{MethodName}
+	Body         string             // request body field, "*" for the whole request
+	ResponseBody string             // response body field, "" for the whole response
+	Source       RouteSource        // origin of the HTTP rule
+	Conns        []*grpc.ClientConn // handlers of the method, nil for local services
+}
+
+// Routes returns every route bound on the mux sorted by template and verb.
+func (m *Mux) Routes() []Route {
+	s := m.loadState()
+	if s == nil {
+		return nil
+	}
+
+	var routes []Route
+	add := func(mt *method) {
+		r := Route{
+			Verb:         mt.verb,
+			Template:     mt.tmpl,
+			Method:       mt.name,
+			Body:         mt.rule.GetBody(),
+			ResponseBody: mt.rule.GetResponseBody(),
+			Source:       mt.source,
+		}
+		for _, hd := range s.handlers[mt.name] {
+			r.Conns = append(r.Conns, hd.conn)
+		}
+		routes = append(routes, r)
+	}
+	var walk func(p *path)
+	walk = func(p *path) {
+		for _, mt := range p.methods {
+			add(mt)
+		}
+		if p.methodAll != nil {
+			add(p.methodAll)
+		}
+		for _, next := range p.segments {
+			walk(next)
+		}
+		for _, v := range p.variables {
+			walk(v.next)
+		}
+	}
+	walk(s.path)
+
+	sort.Slice(routes, func(i, j int) bool {
+		if routes[i].Template != routes[j].Template {
+			return routes[i].Template < routes[j].Template
+		}
+		return routes[i].Verb < routes[j].Verb
+	})
+	return routes
+}
+
+// routeJSON is the JSON form of a route.
+type routeJSON struct {
+	Verb         string      `json:"verb"`
+	Template     string      `json:"template"`
+	Method       string      `json:"method"`
+	Body         string      `json:"body,omitempty"`
+	ResponseBody string      `json:"responseBody,omitempty"`
+	Source       RouteSource `json:"source"`
+	Backends     []string    `json:"backends"`
+}
+
+func routeBackends(r Route) []string {
+	backends := make([]string, len(r.Conns))
+	for i, cc := range r.Conns {
+		if cc == nil {
+			backends[i] = "local"
+		} else {
+			backends[i] = cc.Target()
+		}
+	}
+	return backends
+}
+
+var routesTemplate = template.Must(template.New("routes").Parse(`<!DOCTYPE html>
+<html>
+<head><title>larking routes</title></head>
+<body>
+<table>
+<tr><th>Verb</th><th>Template</th><th>Method</th><th>Body</th><th>Response Body</th><th>Source</th><th>Backends</th></tr>
+{{- range .}}
+<tr><td>{{.Verb}}</td><td>{{.Template}}</td><td>{{.Method}}</td><td>{{.Body}}</td><td>{{.ResponseBody}}</td><td>{{.Source}}</td><td>{{range $i, $b := .Backends}}{{if $i}}, {{end}}{{$b}}{{end}}</td></tr>
+{{- end}}
+</table>
+</body>
+</html>
+`))
+
+// RoutesHandler returns a debug handler listing the routes of the mux as HTML,
+// or as JSON if requested by the Accept header or ?format=json. Mount it on a
+// server with HTTPHandlerOption("/debug/larking/routes", mux.RoutesHandler()).
+func (m *Mux) RoutesHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		routes := m.Routes()
+		views := make([]routeJSON, len(routes))
+		for i, rt := range routes {
+			views[i] = routeJSON{
+				Verb:         rt.Verb,
+				Template:     rt.Template,
+				Method:       rt.Method,
+				Body:         rt.Body,
+				ResponseBody: rt.ResponseBody,
+				Source:       rt.Source,
+				Backends:     routeBackends(rt),
+			}
+		}
+
+		offers := []string{"text/html", "application/json"}
+		if r.URL.Query().Get("format") == "json" ||
+			negotiateContentType(r.Header, offers, "text/html") == "application/json" {
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(views); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			}
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := routesTemplate.Execute(w, views); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
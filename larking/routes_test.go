@@ -0,0 +1,116 @@
+// Copyright 2024 Edward McFarlane. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package larking
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"google.golang.org/genproto/googleapis/api/serviceconfig"
+	"google.golang.org/grpc"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+
+	"larking.io/api/testpb"
+	"larking.io/health"
+)
+
+func TestRoutes(t *testing.T) {
+	serviceConfig := &serviceconfig.Service{}
+	health.AddHealthz(serviceConfig)
+
+	mux, err := NewMux(ServiceConfigOption(serviceConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs := health.NewServer()
+	defer hs.Shutdown()
+	mux.RegisterService(&healthpb.Health_ServiceDesc, hs)
+	mux.RegisterService(&testpb.Messaging_ServiceDesc, &testpb.UnimplementedMessagingServer{})
+
+	routes := mux.Routes()
+	find := func(verb, tmpl string) *Route {
+		for i := range routes {
+			if routes[i].Verb == verb && routes[i].Template == tmpl {
+				return &routes[i]
+			}
+		}
+		t.Fatalf("missing route %s %s in %v", verb, tmpl, routes)
+		return nil
+	}
+
+	local := []*grpc.ClientConn{nil}
+	for _, want := range []Route{{
+		Verb:     "*",
+		Template: "/grpc.health.v1.Health/Check",
+		Method:   "/grpc.health.v1.Health/Check",
+		Body:     "*",
+		Source:   RouteSourceImplicit,
+		Conns:    local,
+	}, {
+		Verb:     http.MethodGet,
+		Template: "/v1/healthz",
+		Method:   "/grpc.health.v1.Health/Check",
+		Source:   RouteSourceServiceConfig,
+		Conns:    local,
+	}, {
+		Verb:     http.MethodGet,
+		Template: "/v1/messages/{name=name/*}",
+		Method:   "/larking.testpb.Messaging/GetMessageOne",
+		Source:   RouteSourceAnnotation,
+		Conns:    local,
+	}, {
+		Verb:     http.MethodGet,
+		Template: "/v1/users/{user_id}/messages/{message_id}",
+		Method:   "/larking.testpb.Messaging/GetMessageTwo",
+		Source:   RouteSourceAnnotation,
+		Conns:    local,
+	}} {
+		got := find(want.Verb, want.Template)
+		if diff := cmp.Diff(want, *got); diff != "" {
+			t.Error(diff)
+		}
+	}
+
+	// Sorted by template.
+	for i := 1; i < len(routes); i++ {
+		if routes[i-1].Template > routes[i].Template {
+			t.Fatalf("routes not sorted: %s > %s", routes[i-1].Template, routes[i].Template)
+		}
+	}
+
+	t.Run("handlerJSON", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/debug/larking/routes", nil)
+		r.Header.Set("Accept", "application/json")
+		w := httptest.NewRecorder()
+		mux.RoutesHandler().ServeHTTP(w, r)
+
+		var got []routeJSON
+		if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+			t.Fatal(err, w.Body.String())
+		}
+		if len(got) != len(routes) {
+			t.Fatalf("got %d routes, want %d", len(got), len(routes))
+		}
+		if !strings.Contains(w.Body.String(), `"source":"service_config"`) {
+			t.Fatalf("missing source in %s", w.Body.String())
+		}
+	})
+	t.Run("handlerHTML", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/debug/larking/routes", nil)
+		w := httptest.NewRecorder()
+		mux.RoutesHandler().ServeHTTP(w, r)
+
+		if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/html") {
+			t.Fatalf("got content type %s", ct)
+		}
+		if !strings.Contains(w.Body.String(), "<td>/v1/healthz</td>") {
+			t.Fatalf("missing route in %s", w.Body.String())
+		}
+	})
+}
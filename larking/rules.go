@@ -17,12 +17,15 @@ import (
 
 	"google.golang.org/genproto/googleapis/api/annotations"
 	_ "google.golang.org/genproto/googleapis/api/httpbody"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/encoding/protojson"
 	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
 	_ "google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
 	"google.golang.org/protobuf/types/known/durationpb"
 	"google.golang.org/protobuf/types/known/fieldmaskpb"
 	"google.golang.org/protobuf/types/known/timestamppb"
@@ -129,9 +132,13 @@ func newPath() *path {
 type method struct {
 	desc    protoreflect.MethodDescriptor
 	name    string                           // /{ServiceName}/{MethodName}
+	verb    string                           // HTTP method or "*"
+	tmpl    string                           // path template
+	rule    *annotations.HttpRule            // RO
+	source  RouteSource                      // origin of the rule
 	body    []protoreflect.FieldDescriptor   // body
 	vars    [][]protoreflect.FieldDescriptor // variables on path
-	resp    []protoreflect.FieldDescriptor   // body=[""|"*"]
+	resp    []protoreflect.FieldDescriptor   // response_body, resolved on the output
 	hasBody bool                             // body="*" or body="field.name" or body="" for no body
 }
 
@@ -139,6 +146,20 @@ func (m *method) String() string {
 	return m.name
 }
 
+// responseBody returns the message selected by the response_body of the
+// method. If the last field isn't a singular message, its parent message is
+// returned with the field.
+func (m *method) responseBody(reply protoreflect.Message) (protoreflect.Message, protoreflect.FieldDescriptor) {
+	cur := reply
+	for i, fd := range m.resp {
+		if i == len(m.resp)-1 && (fd.Message() == nil || fd.IsList() || fd.IsMap()) {
+			return cur, fd
+		}
+		cur = cur.Get(fd).Message()
+	}
+	return cur, nil
+}
+
 func fieldPath(fieldDescs protoreflect.FieldDescriptors, names ...string) []protoreflect.FieldDescriptor {
 	fds := make([]protoreflect.FieldDescriptor, len(names))
 	for i, name := range names {
@@ -166,6 +187,7 @@ func fieldPath(fieldDescs protoreflect.FieldDescriptors, names ...string) []prot
 
 func (p *path) alive() bool {
 	return len(p.methods) != 0 ||
+		p.methodAll != nil ||
 		len(p.variables) != 0 ||
 		len(p.segments) != 0
 }
@@ -198,35 +220,41 @@ func (p *path) clone() *path {
 	return pc
 }
 
-// delRule deletes the HTTP rule to the path.
+// delRule deletes all HTTP rules of the method from the path.
 func (p *path) delRule(name string) bool {
+	var ok bool
 	for k, s := range p.segments {
-		if ok := s.delRule(name); ok {
+		if s.delRule(name) {
+			ok = true
 			if !s.alive() {
 				delete(p.segments, k)
 			}
-			return ok
 		}
 	}
 
-	for i, v := range p.variables {
-		if ok := v.next.delRule(name); ok {
+	vars := p.variables[:0]
+	for _, v := range p.variables {
+		if v.next.delRule(name) {
+			ok = true
 			if !v.next.alive() {
-				p.variables = append(
-					p.variables[:i], p.variables[i+1:]...,
-				)
+				continue
 			}
-			return ok
 		}
+		vars = append(vars, v)
 	}
+	p.variables = vars
 
 	for k, m := range p.methods {
 		if m.name == name {
 			delete(p.methods, k)
-			return true
+			ok = true
 		}
 	}
-	return false
+	if m := p.methodAll; m != nil && m.name == name {
+		p.methodAll = nil
+		ok = true
+	}
+	return ok
 }
 
 // addRule adds the HTTP rule to the path.
@@ -234,6 +262,7 @@ func (p *path) addRule(
 	rule *annotations.HttpRule,
 	desc protoreflect.MethodDescriptor,
 	name string,
+	source RouteSource,
 ) error {
 	var tmpl, verb string
 	switch v := rule.Pattern.(type) {
@@ -278,7 +307,7 @@ func (p *path) addRule(
 		i++
 		return l.toks[i]
 	}
-	invalid := func(tok token) { panic(fmt.Sprintf("invalid token: %v", tok)) }
+	invalid := func(tok token) error { return fmt.Errorf("invalid token: %v", tok) }
 
 	// Segments
 	tok := l.toks[i]
@@ -321,7 +350,7 @@ func (p *path) addRule(
 				})
 
 			default:
-				invalid(nxt)
+				return invalid(nxt)
 			}
 
 			fds := fieldPath(fieldDescs, keys...)
@@ -334,7 +363,7 @@ func (p *path) addRule(
 			cursor = v.next
 
 		default:
-			invalid(tok)
+			return invalid(tok)
 		}
 	}
 
@@ -349,10 +378,14 @@ func (p *path) addRule(
 		// eof
 
 	default:
-		invalid(tok)
+		return invalid(tok)
 	}
 
-	if y, ok := cursor.methods[verb]; ok || cursor.methodAll != nil {
+	y, ok := cursor.methods[verb]
+	if !ok && cursor.methodAll != nil {
+		y, ok = cursor.methodAll, true
+	}
+	if ok {
 		if y.desc.FullName() != desc.FullName() {
 			return fmt.Errorf("duplicate rule %v", rule)
 		}
@@ -360,9 +393,13 @@ func (p *path) addRule(
 	}
 
 	m := &method{
-		desc: desc,
-		vars: varfds,
-		name: name,
+		desc:   desc,
+		vars:   varfds,
+		name:   name,
+		verb:   verb,
+		tmpl:   tmpl,
+		rule:   rule,
+		source: source,
 	}
 	switch rule.Body {
 	case "*":
@@ -380,9 +417,15 @@ func (p *path) addRule(
 	switch rule.ResponseBody {
 	case "":
 	default:
-		m.resp = fieldPath(fieldDescs, strings.Split(rule.Body, ".")...)
+		outDesc := desc.Output()
+		m.resp = fieldPath(outDesc.Fields(), strings.Split(rule.ResponseBody, ".")...)
 		if m.resp == nil {
-			return fmt.Errorf("response body field error %v", rule.ResponseBody)
+			return fmt.Errorf("response body field %q not found in %s", rule.ResponseBody, outDesc.FullName())
+		}
+		for _, fd := range m.resp[:len(m.resp)-1] {
+			if fd.IsList() || fd.IsMap() {
+				return fmt.Errorf("response body field %q must not traverse repeated field %s", rule.ResponseBody, fd.Name())
+			}
 		}
 	}
 
@@ -398,7 +441,7 @@ func (p *path) addRule(
 			return fmt.Errorf("nested rules") // TODO: errors...
 		}
 
-		if err := p.addRule(addRule, desc, name); err != nil {
+		if err := p.addRule(addRule, desc, name, source); err != nil {
 			return err
 		}
 	}
@@ -416,13 +459,24 @@ func quote(raw []byte) []byte {
 type param struct {
 	val protoreflect.Value
 	fds []protoreflect.FieldDescriptor
+	key protoreflect.MapKey // key of the map field in fds
+	idx int                 // index of the repeated message field in fds
+}
+
+// typeResolver resolves Any messages of params with the mux types.
+type typeResolver struct {
+	protoregistry.MessageTypeResolver
+	protoregistry.ExtensionTypeResolver
 }
 
-func parseParam(fds []protoreflect.FieldDescriptor, raw []byte) (param, error) {
+func parseParam(fds []protoreflect.FieldDescriptor, raw []byte, types protoregistry.MessageTypeResolver) (param, error) {
 	if len(fds) == 0 {
 		return param{}, fmt.Errorf("zero field")
 	}
 	fd := fds[len(fds)-1]
+	if fd.IsMap() {
+		fd = fd.MapValue()
+	}
 
 	switch kind := fd.Kind(); kind {
 	case protoreflect.BoolKind:
@@ -588,9 +642,25 @@ func parseParam(fds []protoreflect.FieldDescriptor, raw []byte) (param, error) {
 					return param{}, err
 				}
 				return param{fds: fds, val: protoreflect.ValueOfMessage(msg.ProtoReflect())}, nil
+			case "Value":
+				// Non JSON values are strings.
+				if !json.Valid(raw) {
+					raw = quote(raw)
+				}
 			}
 		}
-		return param{}, fmt.Errorf("unexpected message type %s", name)
+
+		// Other messages, like Struct, ListValue and Any, are decoded from
+		// JSON and converted to the request type on set.
+		opts := protojson.UnmarshalOptions{}
+		if types != nil {
+			opts.Resolver = typeResolver{types, protoregistry.GlobalTypes}
+		}
+		msg := dynamicpb.NewMessage(md)
+		if err := opts.Unmarshal(raw, msg); err != nil {
+			return param{}, fmt.Errorf("invalid value for %s: %w", name, err)
+		}
+		return param{fds: fds, val: protoreflect.ValueOfMessage(msg)}, nil
 
 	default:
 		return param{}, fmt.Errorf("unknown param type %s", kind)
@@ -605,6 +675,22 @@ func isNullValue(fd protoreflect.FieldDescriptor) bool {
 
 type params []param
 
+// convertValue converts message values to the type of v.
+func convertValue(val, v protoreflect.Value) (protoreflect.Value, error) {
+	msg, ok := val.Interface().(protoreflect.Message)
+	if !ok || msg.Type() == v.Message().Type() {
+		return val, nil
+	}
+	b, err := proto.Marshal(msg.Interface())
+	if err != nil {
+		return val, err
+	}
+	if err := proto.Unmarshal(b, v.Message().Interface()); err != nil {
+		return val, err
+	}
+	return v, nil
+}
+
 func (ps params) set(m proto.Message) error {
 	for _, p := range ps {
 		cur := m.ProtoReflect()
@@ -613,37 +699,156 @@ func (ps params) set(m proto.Message) error {
 				switch {
 				case fd.IsList():
 					l := cur.Mutable(fd).List()
-					l.Append(p.val)
+					val := p.val
+					if fd.Message() != nil {
+						var err error
+						if val, err = convertValue(val, l.NewElement()); err != nil {
+							return err
+						}
+					}
+					l.Append(val)
 				case fd.IsMap():
-					return fmt.Errorf("map fields are not supported")
+					if !p.key.IsValid() {
+						return fmt.Errorf("missing key for map field %s", fd.Name())
+					}
+					mp := cur.Mutable(fd).Map()
+					val := p.val
+					if fd.MapValue().Message() != nil {
+						var err error
+						if val, err = convertValue(val, mp.NewValue()); err != nil {
+							return err
+						}
+					}
+					mp.Set(p.key, val)
 				default:
-					cur.Set(fd, p.val)
+					val := p.val
+					if fd.Message() != nil {
+						var err error
+						if val, err = convertValue(val, cur.NewField(fd)); err != nil {
+							return err
+						}
+					}
+					cur.Set(fd, val)
 				}
 				break
 			}
 
-			cur = cur.Mutable(fd).Message()
+			switch {
+			case fd.IsList():
+				// Repeated messages are indexed by the order of the values.
+				l := cur.Mutable(fd).List()
+				for l.Len() <= p.idx {
+					l.Append(l.NewElement())
+				}
+				cur = l.Get(p.idx).Message()
+			case fd.IsMap():
+				if !p.key.IsValid() {
+					return fmt.Errorf("missing key for map field %s", fd.Name())
+				}
+				cur = cur.Mutable(fd).Map().Mutable(p.key).Message()
+			default:
+				cur = cur.Mutable(fd).Message()
+			}
 		}
 	}
 	return nil
 }
 
-func (m *method) parseQueryParams(values url.Values) (params, error) {
+// queryFieldPath resolves a query param key to its field path. Map fields
+// are keyed by the following segment or in brackets, like "labels.env" or
+// "labels[env]", and may be followed by fields of message values.
+func queryFieldPath(fieldDescs protoreflect.FieldDescriptors, key string) ([]protoreflect.FieldDescriptor, string, bool) {
+	var (
+		fds    []protoreflect.FieldDescriptor
+		mapKey string
+		hasKey bool
+	)
+	for rest := key; ; {
+		name := rest
+		if i := strings.IndexAny(rest, ".["); i != -1 {
+			name = rest[:i]
+		}
+		rest = rest[len(name):]
+
+		fd := fieldDescs.ByJSONName(name)
+		if fd == nil {
+			fd = fieldDescs.ByName(protoreflect.Name(name))
+		}
+		if fd == nil {
+			return nil, "", false
+		}
+		fds = append(fds, fd)
+
+		md := fd.Message()
+		if fd.IsMap() {
+			if hasKey {
+				return nil, "", false // nested maps
+			}
+			switch {
+			case strings.HasPrefix(rest, "["):
+				i := strings.IndexByte(rest, ']')
+				if i == -1 {
+					return nil, "", false
+				}
+				mapKey, rest = rest[1:i], rest[i+1:]
+			case strings.HasPrefix(rest, "."):
+				rest = rest[1:]
+				i := strings.IndexAny(rest, ".[")
+				if i == -1 {
+					i = len(rest)
+				}
+				mapKey, rest = rest[:i], rest[i:]
+			default:
+				return nil, "", false
+			}
+			hasKey = true
+			md = fd.MapValue().Message()
+		}
+		if rest == "" {
+			return fds, mapKey, hasKey
+		}
+
+		// advance
+		if md == nil || !strings.HasPrefix(rest, ".") {
+			return nil, "", false
+		}
+		rest = rest[1:]
+		fieldDescs = md.Fields()
+	}
+}
+
+func (m *method) parseQueryParams(values url.Values, types protoregistry.MessageTypeResolver) (params, error) {
 	msgDesc := m.desc.Input()
 	fieldDescs := msgDesc.Fields()
 
 	var ps params
 	for key, vs := range values {
-		fds := fieldPath(fieldDescs, strings.Split(key, ".")...)
+		fds, mapKey, hasKey := queryFieldPath(fieldDescs, key)
 		if fds == nil {
 			return nil, status.Errorf(codes.InvalidArgument, "unknown query param %q", key)
 		}
 
-		for _, v := range vs {
-			p, err := parseParam(fds, []byte(v))
+		var k protoreflect.MapKey
+		if hasKey {
+			for _, fd := range fds {
+				if !fd.IsMap() {
+					continue
+				}
+				kp, err := parseParam([]protoreflect.FieldDescriptor{fd.MapKey()}, []byte(mapKey), nil)
+				if err != nil {
+					return nil, status.Errorf(codes.InvalidArgument, "invalid map key in query param %q: %v", key, err)
+				}
+				k = kp.val.MapKey()
+			}
+		}
+
+		for i, v := range vs {
+			p, err := parseParam(fds, []byte(v), types)
 			if err != nil {
-				return nil, err
+				return nil, status.Errorf(codes.InvalidArgument, "invalid query param %q: %v", key, err)
 			}
+			p.key = k
+			p.idx = i
 			ps = append(ps, p)
 		}
 	}
@@ -740,7 +945,7 @@ func (p *path) search(toks tokens, verb string) (*method, params, error) {
 		if len(fds) > 0 {
 			capture := []byte(toks[1:l].String())
 
-			p, err = parseParam(fds, capture)
+			p, err = parseParam(fds, capture, nil)
 			if err != nil {
 				return nil, nil, err
 			}
@@ -751,12 +956,102 @@ func (p *path) search(toks tokens, verb string) (*method, params, error) {
 	return nil, nil, errNotFound
 }
 
-// match the route to a method.
+// allow collects the verbs bound to the route, "*" for any verb.
+func (p *path) allow(toks tokens, verbs map[string]bool) {
+	if n := len(toks); n <= 1 {
+		for verb := range p.methods {
+			verbs[verb] = true
+		}
+		if p.methodAll != nil {
+			verbs["*"] = true
+		}
+		return
+	}
+
+	segment := toks[0].val + toks[1].val
+	if next, ok := p.segments[segment]; ok {
+		next.allow(toks[2:], verbs)
+	}
+	for _, v := range p.variables {
+		l := v.index(toks[1:]) + 1 // bump off /
+		if l == 0 {
+			continue
+		}
+		v.next.allow(toks[l:], verbs)
+	}
+}
+
+// ErrorInfo domain of mux errors.
+const errorDomain = "larking.io"
+
+// ReasonMethodNotAllowed is the ErrorInfo reason of requests with a verb the
+// route doesn't allow, encoded as HTTP 405.
+const ReasonMethodNotAllowed = "METHOD_NOT_ALLOWED"
+
+// methodNotAllowedError is returned when the route matches but the verb
+// doesn't, listing the allowed verbs.
+type methodNotAllowedError struct {
+	allow []string
+}
+
+func newMethodNotAllowedError(verbs map[string]bool) *methodNotAllowedError {
+	if verbs[http.MethodGet] {
+		verbs[http.MethodHead] = true
+	}
+	verbs[http.MethodOptions] = true
+	delete(verbs, kindWebsocket)
+
+	allow := make([]string, 0, len(verbs))
+	for verb := range verbs {
+		allow = append(allow, verb)
+	}
+	sort.Strings(allow)
+	return &methodNotAllowedError{allow: allow}
+}
+
+func (e *methodNotAllowedError) Error() string {
+	return "method not allowed"
+}
+
+// GRPCStatus is InvalidArgument with the ErrorInfo reason
+// ReasonMethodNotAllowed and the allowed verbs as the "allow" metadata.
+func (e *methodNotAllowedError) GRPCStatus() *status.Status {
+	st := status.New(codes.InvalidArgument, e.Error())
+	if dt, err := st.WithDetails(&errdetails.ErrorInfo{
+		Reason:   ReasonMethodNotAllowed,
+		Domain:   errorDomain,
+		Metadata: map[string]string{"allow": e.Allow()},
+	}); err == nil {
+		st = dt
+	}
+	return st
+}
+
+// Allow returns the Allow header value.
+func (e *methodNotAllowedError) Allow() string {
+	return strings.Join(e.allow, ", ")
+}
+
+// match the route to a method. HEAD requests fall back to GET bindings.
 func (p *path) match(route, verb string) (*method, params, error) {
 	l := &lexer{input: route}
 
 	if err := lexPath(l); err != nil {
 		return nil, nil, status.Errorf(codes.NotFound, "not found: %v", err)
 	}
-	return p.search(l.tokens(), verb)
+	toks := l.tokens()
+	m, ps, err := p.search(toks, verb)
+	if err != errNotFound && err != errMethod {
+		return m, ps, err
+	}
+
+	verbs := make(map[string]bool)
+	p.allow(toks, verbs)
+	if len(verbs) == 0 {
+		return nil, nil, errNotFound
+	}
+	if verb == http.MethodHead && verbs[http.MethodGet] {
+		return p.search(toks, http.MethodGet)
+	}
+	return nil, nil, newMethodNotAllowedError(verbs)
 }
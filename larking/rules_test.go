@@ -15,27 +15,34 @@ import (
 	"net/url"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"golang.org/x/sync/errgroup"
 	"google.golang.org/genproto/googleapis/api/annotations"
 	"google.golang.org/genproto/googleapis/api/httpbody"
 	"google.golang.org/genproto/googleapis/api/serviceconfig"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/genproto/googleapis/rpc/status"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/reflection"
 	"google.golang.org/protobuf/encoding/protojson"
 	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/testing/protocmp"
+	"google.golang.org/protobuf/types/known/anypb"
 	"google.golang.org/protobuf/types/known/durationpb"
 	"google.golang.org/protobuf/types/known/emptypb"
 	"google.golang.org/protobuf/types/known/fieldmaskpb"
+	"google.golang.org/protobuf/types/known/structpb"
 	"google.golang.org/protobuf/types/known/timestamppb"
 	"google.golang.org/protobuf/types/known/wrapperspb"
 
 	"larking.io/api/testpb"
+	"larking.io/health"
 )
 
 type in struct {
@@ -667,6 +674,140 @@ func TestMessageServer(t *testing.T) {
 			statusCode: 200,
 			msg:        &emptypb.Empty{},
 		},
+	}, {
+		name: "complex-map",
+		req: httptest.NewRequest(
+			http.MethodGet,
+			"/v1/complex?"+
+				url.Values{
+					// map values
+					"string_map[hello]": []string{"world"},
+					"string_map.foo":    []string{"bar"},
+					"int32_map[1]":      []string{"2"},
+					"bool_map[true]":    []string{"false"},
+					"bytes_map[b]":      []string{"aGk="},
+					"enum_map.a":        []string{"ENUM_VALUE"},
+
+					// message map values
+					"nested_map[a].int32_value": []string{"1"},
+					"nested_map.b.string_value": []string{"b"},
+
+					// repeated message values
+					"nested_list.int32_value":  []string{"1", "2"},
+					"nested_list.string_value": []string{"one"},
+				}.Encode(),
+			nil,
+		),
+		inouts: []any{
+			in{
+				method: "/larking.testpb.Complex/Check",
+				msg: &testpb.ComplexRequest{
+					StringMap: map[string]string{
+						"hello": "world",
+						"foo":   "bar",
+					},
+					Int32Map: map[int32]int32{1: 2},
+					BoolMap:  map[bool]bool{true: false},
+					BytesMap: map[string][]byte{"b": []byte("hi")},
+					EnumMap: map[string]testpb.ComplexRequest_Enum{
+						"a": testpb.ComplexRequest_ENUM_VALUE,
+					},
+					NestedMap: map[string]*testpb.ComplexRequest_Nested{
+						"a": {Int32Value: 1},
+						"b": {StringValue: "b"},
+					},
+					NestedList: []*testpb.ComplexRequest_Nested{
+						{Int32Value: 1, StringValue: "one"},
+						{Int32Value: 2},
+					},
+				},
+			},
+			out{
+				msg: &emptypb.Empty{},
+			},
+		},
+		want: want{
+			statusCode: 200,
+			msg:        &emptypb.Empty{},
+		},
+	}, {
+		name: "complex-json",
+		req: httptest.NewRequest(
+			http.MethodGet,
+			"/v1/complex?"+
+				url.Values{
+					"struct":        []string{`{"env":"prod","count":2}`},
+					"value":         []string{"hello"},
+					"list_value":    []string{`[1,"two",true]`},
+					"any":           []string{`{"@type":"type.googleapis.com/google.protobuf.Duration","value":"1s"}`},
+					"nested":        []string{`{"int32Value":1}`},
+					"nested_map[a]": []string{`{"stringValue":"a"}`},
+				}.Encode(),
+			nil,
+		),
+		inouts: []any{
+			in{
+				method: "/larking.testpb.Complex/Check",
+				msg: &testpb.ComplexRequest{
+					Struct: &structpb.Struct{Fields: map[string]*structpb.Value{
+						"env":   structpb.NewStringValue("prod"),
+						"count": structpb.NewNumberValue(2),
+					}},
+					Value: structpb.NewStringValue("hello"),
+					ListValue: &structpb.ListValue{Values: []*structpb.Value{
+						structpb.NewNumberValue(1),
+						structpb.NewStringValue("two"),
+						structpb.NewBoolValue(true),
+					}},
+					Any: func() *anypb.Any {
+						a, err := anypb.New(durationpb.New(time.Second))
+						if err != nil {
+							t.Fatal(err)
+						}
+						return a
+					}(),
+					Nested: &testpb.ComplexRequest_Nested{
+						Int32Value: 1,
+					},
+					NestedMap: map[string]*testpb.ComplexRequest_Nested{
+						"a": {StringValue: "a"},
+					},
+				},
+			},
+			out{
+				msg: &emptypb.Empty{},
+			},
+		},
+		want: want{
+			statusCode: 200,
+			msg:        &emptypb.Empty{},
+		},
+	}, {
+		name: "complex-json/400",
+		req: httptest.NewRequest(
+			http.MethodGet,
+			"/v1/complex?"+
+				url.Values{
+					"struct": []string{"notjson"},
+				}.Encode(),
+			nil,
+		),
+		want: want{
+			statusCode: 400,
+		},
+	}, {
+		name: "complex-map/400",
+		req: httptest.NewRequest(
+			http.MethodGet,
+			"/v1/complex?"+
+				url.Values{
+					"int32_map[one]": []string{"2"},
+				}.Encode(),
+			nil,
+		),
+		want: want{
+			statusCode: 400,
+		},
 	}, {
 		name: "complex-star",
 		req: httptest.NewRequest(
@@ -974,3 +1115,95 @@ func TestMessageServer(t *testing.T) {
 //		t.Fatalf("unknown err: %v", err)
 //	}
 //}
+
+func TestMethodNotAllowed(t *testing.T) {
+	serviceConfig := &serviceconfig.Service{}
+	health.AddHealthz(serviceConfig)
+
+	mux, err := NewMux(ServiceConfigOption(serviceConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs := health.NewServer()
+	defer hs.Shutdown()
+	mux.RegisterService(&healthpb.Health_ServiceDesc, hs)
+
+	for _, tt := range []struct {
+		name      string
+		method    string
+		path      string
+		wantCode  int
+		wantAllow string
+		wantBody  bool
+	}{{
+		name:     "get",
+		method:   http.MethodGet,
+		path:     "/v1/healthz",
+		wantCode: http.StatusOK,
+		wantBody: true,
+	}, {
+		name:     "head",
+		method:   http.MethodHead,
+		path:     "/v1/healthz",
+		wantCode: http.StatusOK,
+	}, {
+		name:      "options",
+		method:    http.MethodOptions,
+		path:      "/v1/healthz",
+		wantCode:  http.StatusNoContent,
+		wantAllow: "GET, HEAD, OPTIONS",
+	}, {
+		name:      "post",
+		method:    http.MethodPost,
+		path:      "/v1/healthz",
+		wantCode:  http.StatusMethodNotAllowed,
+		wantAllow: "GET, HEAD, OPTIONS",
+		wantBody:  true,
+	}, {
+		name:      "implicit",
+		method:    http.MethodGet,
+		path:      "/grpc.health.v1.Health/Check",
+		wantCode:  http.StatusOK,
+		wantAllow: "",
+		wantBody:  true,
+	}, {
+		name:     "notFound",
+		method:   http.MethodPost,
+		path:     "/v1/missing",
+		wantCode: http.StatusNotFound,
+		wantBody: true,
+	}} {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.path, nil)
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, r)
+
+			if w.Code != tt.wantCode {
+				t.Fatalf("got status %d, want %d: %s", w.Code, tt.wantCode, w.Body.String())
+			}
+			if got := w.Header().Get("Allow"); got != tt.wantAllow {
+				t.Errorf("got Allow %q, want %q", got, tt.wantAllow)
+			}
+			if got := w.Body.Len() > 0; got != tt.wantBody {
+				t.Errorf("got body %q", w.Body.String())
+			}
+			if tt.wantCode != http.StatusMethodNotAllowed {
+				return
+			}
+			st := &status.Status{}
+			if err := protojson.Unmarshal(w.Body.Bytes(), st); err != nil {
+				t.Fatal(err)
+			}
+			if codes.Code(st.Code) != codes.InvalidArgument || len(st.Details) != 1 {
+				t.Fatalf("unexpected status %v", st)
+			}
+			info := &errdetails.ErrorInfo{}
+			if err := st.Details[0].UnmarshalTo(info); err != nil {
+				t.Fatal(err)
+			}
+			if info.Reason != ReasonMethodNotAllowed || info.Metadata["allow"] != tt.wantAllow {
+				t.Fatalf("unexpected error info %v", info)
+			}
+		})
+	}
+}
@@ -0,0 +1,270 @@
+// Copyright 2024 Edward McFarlane. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package larking
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+
+	"google.golang.org/genproto/googleapis/api/serviceconfig"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"gopkg.in/yaml.v3"
+)
+
+// serviceConfigType is the type of google.api.Service YAML configs.
+const serviceConfigType = "google.api.Service"
+
+// LoadServiceConfig parses a google.api.Service YAML config, such as an
+// api_service.yaml file. Fields may be named in proto or JSON form.
+// Errors report the line of the invalid value.
+func LoadServiceConfig(r io.Reader) (*serviceconfig.Service, error) {
+	var doc yaml.Node
+	if err := yaml.NewDecoder(r).Decode(&doc); err != nil {
+		if err == io.EOF {
+			return nil, fmt.Errorf("service config: empty document")
+		}
+		return nil, fmt.Errorf("service config: %w", err)
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, yamlErrorf(root, "expected mapping")
+	}
+
+	// Strip the type header.
+	fields := &yaml.Node{Kind: yaml.MappingNode, Line: root.Line}
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		key, val := root.Content[i], root.Content[i+1]
+		if key.Value == "type" {
+			if val.Value != serviceConfigType {
+				return nil, yamlErrorf(val, "invalid type %q, expected %s", val.Value, serviceConfigType)
+			}
+			continue
+		}
+		fields.Content = append(fields.Content, key, val)
+	}
+
+	sc := &serviceconfig.Service{}
+	if err := decodeYAMLMessage(fields, sc.ProtoReflect()); err != nil {
+		return nil, err
+	}
+	for _, rule := range sc.GetHttp().GetRules() {
+		if err := checkSelector(rule.GetSelector()); err != nil {
+			return nil, fmt.Errorf("service config: %w", err)
+		}
+	}
+	return sc, nil
+}
+
+// ServiceConfigFileOption loads the google.api.Service YAML config at path
+// and sets it as the service config for the mux, see LoadServiceConfig.
+// Errors are returned by NewMux.
+func ServiceConfigFileOption(path string) MuxOption {
+	return func(opts *muxOptions) {
+		f, err := os.Open(path)
+		if err != nil {
+			opts.err = err
+			return
+		}
+		defer f.Close()
+
+		sc, err := LoadServiceConfig(f)
+		if err != nil {
+			opts.err = fmt.Errorf("%s: %w", path, err)
+			return
+		}
+		ServiceConfigOption(sc)(opts)
+	}
+}
+
+func yamlErrorf(n *yaml.Node, format string, args ...interface{}) error {
+	return fmt.Errorf("service config: line %d: %s", n.Line, fmt.Sprintf(format, args...))
+}
+
+func yamlIsNull(n *yaml.Node) bool {
+	return n.Kind == yaml.ScalarNode && n.Tag == "!!null"
+}
+
+func decodeYAMLMessage(n *yaml.Node, m protoreflect.Message) error {
+	if n.Kind == yaml.AliasNode {
+		n = n.Alias
+	}
+	md := m.Descriptor()
+
+	// Well known types use their JSON mapping.
+	if md.ParentFile().Package() == "google.protobuf" {
+		var v interface{}
+		if err := n.Decode(&v); err != nil {
+			return yamlErrorf(n, "invalid value for %s", md.FullName())
+		}
+		b, err := json.Marshal(v)
+		if err != nil {
+			return yamlErrorf(n, "invalid value for %s: %v", md.FullName(), err)
+		}
+		if err := protojson.Unmarshal(b, m.Interface()); err != nil {
+			return yamlErrorf(n, "invalid value for %s: %v", md.FullName(), err)
+		}
+		return nil
+	}
+
+	if n.Kind != yaml.MappingNode {
+		return yamlErrorf(n, "expected mapping for %s", md.FullName())
+	}
+	fds := md.Fields()
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		key, val := n.Content[i], n.Content[i+1]
+		if val.Kind == yaml.AliasNode {
+			val = val.Alias
+		}
+
+		fd := fds.ByName(protoreflect.Name(key.Value))
+		if fd == nil {
+			fd = fds.ByJSONName(key.Value)
+		}
+		if fd == nil {
+			return yamlErrorf(key, "unknown field %q in %s", key.Value, md.FullName())
+		}
+		if yamlIsNull(val) {
+			continue
+		}
+
+		switch {
+		case fd.IsList():
+			if val.Kind != yaml.SequenceNode {
+				return yamlErrorf(val, "expected sequence for %s", fd.FullName())
+			}
+			list := m.Mutable(fd).List()
+			for _, item := range val.Content {
+				if fd.Message() != nil {
+					v := list.NewElement()
+					if err := decodeYAMLMessage(item, v.Message()); err != nil {
+						return err
+					}
+					list.Append(v)
+					continue
+				}
+				v, err := decodeYAMLScalar(item, fd)
+				if err != nil {
+					return err
+				}
+				list.Append(v)
+			}
+
+		case fd.IsMap():
+			if val.Kind != yaml.MappingNode {
+				return yamlErrorf(val, "expected mapping for %s", fd.FullName())
+			}
+			mp := m.Mutable(fd).Map()
+			for j := 0; j+1 < len(val.Content); j += 2 {
+				k, err := decodeYAMLScalar(val.Content[j], fd.MapKey())
+				if err != nil {
+					return err
+				}
+				mk := k.MapKey()
+				if fd.MapValue().Message() != nil {
+					if err := decodeYAMLMessage(val.Content[j+1], mp.Mutable(mk).Message()); err != nil {
+						return err
+					}
+					continue
+				}
+				v, err := decodeYAMLScalar(val.Content[j+1], fd.MapValue())
+				if err != nil {
+					return err
+				}
+				mp.Set(mk, v)
+			}
+
+		case fd.Message() != nil:
+			if err := decodeYAMLMessage(val, m.Mutable(fd).Message()); err != nil {
+				return err
+			}
+
+		default:
+			v, err := decodeYAMLScalar(val, fd)
+			if err != nil {
+				return err
+			}
+			m.Set(fd, v)
+		}
+	}
+	return nil
+}
+
+func decodeYAMLScalar(n *yaml.Node, fd protoreflect.FieldDescriptor) (protoreflect.Value, error) {
+	if n.Kind != yaml.ScalarNode {
+		return protoreflect.Value{}, yamlErrorf(n, "expected scalar for %s", fd.FullName())
+	}
+	invalid := func() (protoreflect.Value, error) {
+		return protoreflect.Value{}, yamlErrorf(n, "invalid value %q for %s", n.Value, fd.FullName())
+	}
+
+	switch fd.Kind() {
+	case protoreflect.BoolKind:
+		var v bool
+		if err := n.Decode(&v); err != nil {
+			return invalid()
+		}
+		return protoreflect.ValueOfBool(v), nil
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind:
+		var v int32
+		if err := n.Decode(&v); err != nil {
+			return invalid()
+		}
+		return protoreflect.ValueOfInt32(v), nil
+	case protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind:
+		var v int64
+		if err := n.Decode(&v); err != nil {
+			return invalid()
+		}
+		return protoreflect.ValueOfInt64(v), nil
+	case protoreflect.Uint32Kind, protoreflect.Fixed32Kind:
+		var v uint32
+		if err := n.Decode(&v); err != nil {
+			return invalid()
+		}
+		return protoreflect.ValueOfUint32(v), nil
+	case protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		var v uint64
+		if err := n.Decode(&v); err != nil {
+			return invalid()
+		}
+		return protoreflect.ValueOfUint64(v), nil
+	case protoreflect.FloatKind:
+		var v float32
+		if err := n.Decode(&v); err != nil {
+			return invalid()
+		}
+		return protoreflect.ValueOfFloat32(v), nil
+	case protoreflect.DoubleKind:
+		var v float64
+		if err := n.Decode(&v); err != nil {
+			return invalid()
+		}
+		return protoreflect.ValueOfFloat64(v), nil
+	case protoreflect.StringKind:
+		return protoreflect.ValueOfString(n.Value), nil
+	case protoreflect.BytesKind:
+		b, err := base64.StdEncoding.DecodeString(n.Value)
+		if err != nil {
+			return invalid()
+		}
+		return protoreflect.ValueOfBytes(b), nil
+	case protoreflect.EnumKind:
+		if ev := fd.Enum().Values().ByName(protoreflect.Name(n.Value)); ev != nil {
+			return protoreflect.ValueOfEnum(ev.Number()), nil
+		}
+		i, err := strconv.ParseInt(n.Value, 10, 32)
+		if err != nil {
+			return invalid()
+		}
+		return protoreflect.ValueOfEnum(protoreflect.EnumNumber(i)), nil
+	default:
+		return invalid()
+	}
+}
@@ -0,0 +1,143 @@
+// Copyright 2024 Edward McFarlane. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package larking
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"google.golang.org/genproto/googleapis/api/annotations"
+	"google.golang.org/genproto/googleapis/api/serviceconfig"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/protobuf/testing/protocmp"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
+	"larking.io/health"
+)
+
+func TestLoadServiceConfig(t *testing.T) {
+	const config = `type: google.api.Service
+config_version: 3
+name: library.example.com
+
+http:
+  rules:
+  - selector: larking.testpb.Messaging.GetMessageOne
+    get: /v1/messages/{name}
+    additional_bindings:
+    - get: /v1/users/{name}/messages
+  - selector: larking.testpb.Messaging.UpdateMessage
+    patch: /v1/messages/{message_id}
+    body: message
+    responseBody: text
+  - selector: larking.testpb.Messaging.Action
+    custom:
+      kind: HEAD
+      path: /v1/action
+`
+	want := &serviceconfig.Service{
+		ConfigVersion: wrapperspb.UInt32(3),
+		Name:          "library.example.com",
+		Http: &annotations.Http{Rules: []*annotations.HttpRule{{
+			Selector: "larking.testpb.Messaging.GetMessageOne",
+			Pattern:  &annotations.HttpRule_Get{Get: "/v1/messages/{name}"},
+			AdditionalBindings: []*annotations.HttpRule{{
+				Pattern: &annotations.HttpRule_Get{Get: "/v1/users/{name}/messages"},
+			}},
+		}, {
+			Selector:     "larking.testpb.Messaging.UpdateMessage",
+			Pattern:      &annotations.HttpRule_Patch{Patch: "/v1/messages/{message_id}"},
+			Body:         "message",
+			ResponseBody: "text",
+		}, {
+			Selector: "larking.testpb.Messaging.Action",
+			Pattern: &annotations.HttpRule_Custom{Custom: &annotations.CustomHttpPattern{
+				Kind: "HEAD",
+				Path: "/v1/action",
+			}},
+		}}},
+	}
+
+	got, err := LoadServiceConfig(strings.NewReader(config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(want, got, protocmp.Transform()); diff != "" {
+		t.Fatal(diff)
+	}
+
+	for _, tt := range []struct {
+		name   string
+		config string
+		want   string
+	}{{
+		name:   "type",
+		config: "type: google.api.Other\n",
+		want:   `line 1: invalid type "google.api.Other"`,
+	}, {
+		name:   "unknownField",
+		config: "type: google.api.Service\nhttp:\n  rulez: []\n",
+		want:   `line 3: unknown field "rulez" in google.api.Http`,
+	}, {
+		name:   "invalidValue",
+		config: "type: google.api.Service\nhttp:\n  fully_decode_reserved_expansion: maybe\n",
+		want:   `line 3: invalid value "maybe" for google.api.Http.fully_decode_reserved_expansion`,
+	}, {
+		name:   "expectedSequence",
+		config: "type: google.api.Service\nhttp:\n  rules:\n    selector: foo\n",
+		want:   "line 4: expected sequence for google.api.Http.rules",
+	}, {
+		name:   "selector",
+		config: "type: google.api.Service\nhttp:\n  rules:\n  - selector: foo.*.bar\n",
+		want:   `invalid selector "foo.*.bar"`,
+	}} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := LoadServiceConfig(strings.NewReader(tt.config))
+			if err == nil {
+				t.Fatal("expected error")
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("got %q, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestServiceConfigFileOption(t *testing.T) {
+	const config = `type: google.api.Service
+http:
+  rules:
+  - selector: grpc.health.v1.Health.Check
+    get: /healthz
+`
+	path := filepath.Join(t.TempDir(), "api_service.yaml")
+	if err := os.WriteFile(path, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	mux, err := NewMux(ServiceConfigFileOption(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs := health.NewServer()
+	defer hs.Shutdown()
+	mux.RegisterService(&healthpb.Health_ServiceDesc, hs)
+
+	r := httptest.NewRequest(http.MethodGet, "/healthz", nil)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", w.Code, w.Body.String())
+	}
+
+	if _, err := NewMux(ServiceConfigFileOption(path + ".missing")); err == nil {
+		t.Fatal("expected missing file error")
+	}
+}
@@ -0,0 +1,153 @@
+// Copyright 2024 Edward McFarlane. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package larking
+
+// Support for server-sent events
+// https://html.spec.whatwg.org/multipage/server-sent-events.html
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	eventStream                 = "text/event-stream"
+	defaultEventStreamHeartbeat = 15 * time.Second
+	eventStreamHeartbeatComment = ": heartbeat\n\n"
+	eventStreamErrorEvent       = "error"
+)
+
+// CodecEventStream is a StreamCodec for server-sent events. Messages are
+// encoded with the protobuf JSON format as the data of each event.
+type CodecEventStream struct {
+	CodecJSON
+}
+
+// ReadNext is unsupported, event streams are server to client only.
+func (CodecEventStream) ReadNext(b []byte, _ io.Reader, _ int) ([]byte, int, error) {
+	return b, 0, fmt.Errorf("event-stream codec does not support reading")
+}
+
+// WriteNext writes the message as a data event.
+func (CodecEventStream) WriteNext(w io.Writer, b []byte) (int, error) {
+	return w.Write(appendEvent(nil, "", "", b))
+}
+
+func (CodecEventStream) Name() string { return "event-stream" }
+
+// appendEvent appends the event, splitting multiline data.
+func appendEvent(dst []byte, event, id string, data []byte) []byte {
+	if event != "" {
+		dst = append(dst, "event: "...)
+		dst = append(dst, event...)
+		dst = append(dst, '\n')
+	}
+	if id != "" {
+		dst = append(dst, "id: "...)
+		dst = append(dst, id...)
+		dst = append(dst, '\n')
+	}
+	for {
+		line, rest, more := bytes.Cut(data, []byte{'\n'})
+		dst = append(dst, "data: "...)
+		dst = append(dst, line...)
+		dst = append(dst, '\n')
+		if !more {
+			break
+		}
+		data = rest
+	}
+	return append(dst, '\n')
+}
+
+// EventStreamHeartbeatOption sets the idle interval of heartbeat comments
+// on server-sent event streams, zero disables heartbeats. Event stream
+// headers are sent as the stream starts so heartbeats are sent before the
+// first event, handlers can't set headers.
+func EventStreamHeartbeatOption(d time.Duration) MuxOption {
+	return func(opts *muxOptions) { opts.eventStreamHeartbeat = d }
+}
+
+// eventWriter writes server-sent events. Writes are serialized with the
+// heartbeat. Event IDs count up from the Last-Event-ID of the request, which
+// handlers read from the "last-event-id" metadata to resume streams.
+type eventWriter struct {
+	mu     sync.Mutex
+	w      io.Writer
+	nextID uint64
+	idle   bool // no events since the last heartbeat tick
+}
+
+func newEventWriter(w io.Writer, lastEventID string) *eventWriter {
+	e := &eventWriter{w: w}
+	if id, err := strconv.ParseUint(lastEventID, 10, 64); err == nil {
+		e.nextID = id + 1
+	}
+	return e
+}
+
+func (e *eventWriter) Write(b []byte) (int, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.w.Write(b)
+}
+
+func (e *eventWriter) Flush() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.flush()
+}
+
+func (e *eventWriter) flush() {
+	if f, ok := e.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// writeEvent writes the data as an event. Error events have no ID.
+func (e *eventWriter) writeEvent(event string, data []byte) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	var id string
+	if event != eventStreamErrorEvent {
+		id = strconv.FormatUint(e.nextID, 10)
+		e.nextID++
+	}
+	e.idle = false
+	_, err := e.w.Write(appendEvent(nil, event, id, data))
+	e.flush()
+	return err
+}
+
+// heartbeat writes comments while the stream is idle, until ctx is done.
+func (e *eventWriter) heartbeat(ctx context.Context, d time.Duration) {
+	t := time.NewTicker(d)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		e.mu.Lock()
+		if e.idle {
+			if _, err := io.WriteString(e.w, eventStreamHeartbeatComment); err != nil {
+				e.mu.Unlock()
+				return
+			}
+			e.flush()
+		}
+		e.idle = true
+		e.mu.Unlock()
+	}
+}
@@ -0,0 +1,126 @@
+// Copyright 2024 Edward McFarlane. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package larking
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	grpc_testing "google.golang.org/grpc/interop/grpc_testing"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+type eventStreamServer struct {
+	responseBodyServer
+	lastEventID chan string
+}
+
+func (s *eventStreamServer) StreamingOutputCall(req *grpc_testing.StreamingOutputCallRequest, stream grpc_testing.TestService_StreamingOutputCallServer) error {
+	md, _ := metadata.FromIncomingContext(stream.Context())
+	s.lastEventID <- strings.Join(md.Get("last-event-id"), ",")
+
+	for _, p := range req.ResponseParameters {
+		time.Sleep(time.Duration(p.IntervalUs) * time.Microsecond)
+		if err := stream.Send(&grpc_testing.StreamingOutputCallResponse{
+			Payload: &grpc_testing.Payload{Body: bytes.Repeat([]byte{'a'}, int(p.Size))},
+		}); err != nil {
+			return err
+		}
+	}
+	if rs := req.ResponseStatus; rs != nil {
+		return status.Error(codes.Code(rs.Code), rs.Message)
+	}
+	return nil
+}
+
+func TestEventStream(t *testing.T) {
+	ts := &eventStreamServer{lastEventID: make(chan string, 1)}
+	m, err := NewMux(EventStreamHeartbeatOption(10 * time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	grpc_testing.RegisterTestServiceServer(m, ts)
+
+	for _, tt := range []struct {
+		name        string
+		target      string
+		lastEventID string
+		want        string
+		contains    string
+	}{{
+		name:   "events",
+		target: "/grpc.testing.TestService/StreamingOutputCall?response_parameters.size=1&response_parameters.size=2",
+		want: "id: 0\ndata: {\"payload\":{\"body\":\"YQ==\"}}\n\n" +
+			"id: 1\ndata: {\"payload\":{\"body\":\"YWE=\"}}\n\n",
+	}, {
+		name:        "lastEventID",
+		target:      "/grpc.testing.TestService/StreamingOutputCall?response_parameters.size=1",
+		lastEventID: "41",
+		want:        "id: 42\ndata: {\"payload\":{\"body\":\"YQ==\"}}\n\n",
+	}, {
+		name:   "error",
+		target: "/grpc.testing.TestService/StreamingOutputCall?response_parameters.size=1&response_status.code=5&response_status.message=missing",
+		contains: "id: 0\ndata: {\"payload\":{\"body\":\"YQ==\"}}\n\n" +
+			"event: error\ndata: {\"code\":5,",
+	}, {
+		name:     "heartbeat",
+		target:   "/grpc.testing.TestService/StreamingOutputCall?response_parameters.size=1&response_parameters.size=2&response_parameters.interval_us=0&response_parameters.interval_us=100000",
+		contains: eventStreamHeartbeatComment,
+	}, {
+		name:     "heartbeatBeforeEvents",
+		target:   "/grpc.testing.TestService/StreamingOutputCall?response_parameters.size=1&response_parameters.interval_us=100000",
+		contains: eventStreamHeartbeatComment + "id: 0\n",
+	}} {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			r.Header.Set("Accept", eventStream)
+			if tt.lastEventID != "" {
+				r.Header.Set("Last-Event-ID", tt.lastEventID)
+			}
+			w := httptest.NewRecorder()
+			m.ServeHTTP(w, r)
+
+			if got := <-ts.lastEventID; got != tt.lastEventID {
+				t.Errorf("got last-event-id %q, want %q", got, tt.lastEventID)
+			}
+			if w.Code != http.StatusOK {
+				t.Fatalf("got status %d: %s", w.Code, w.Body.String())
+			}
+			if ct := w.Header().Get("Content-Type"); ct != eventStream {
+				t.Fatalf("got content type %q", ct)
+			}
+			got := w.Body.String()
+			if tt.want != "" && got != tt.want {
+				t.Fatalf("got %q, want %q", got, tt.want)
+			}
+			if !strings.Contains(got, tt.contains) {
+				t.Fatalf("missing %q in %q", tt.contains, got)
+			}
+		})
+	}
+
+	t.Run("unary", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/grpc.testing.TestService/UnaryCall", nil)
+		r.Header.Set("Accept", eventStream)
+		w := httptest.NewRecorder()
+		m.ServeHTTP(w, r)
+
+		if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+			t.Fatalf("got content type %q: %s", ct, w.Body.String())
+		}
+	})
+	t.Run("multiline", func(t *testing.T) {
+		got := string(appendEvent(nil, "", "", []byte("{\n  \"a\": 1\n}")))
+		if want := "data: {\ndata:   \"a\": 1\ndata: }\n\n"; got != want {
+			t.Fatalf("got %q, want %q", got, want)
+		}
+	})
+}
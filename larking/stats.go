@@ -16,6 +16,15 @@ const (
 	headerLen  = payloadLen + sizeLen
 )
 
+// statsPayload returns the payload of the message for stats. Forwarded frames
+// are not decoded, their stats only report lengths.
+func statsPayload(msg interface{}) interface{} {
+	if _, ok := msg.(*frame); ok {
+		return nil
+	}
+	return msg
+}
+
 func outPayload(client bool, msg interface{}, payload []byte, t time.Time) *stats.OutPayload {
 	return &stats.OutPayload{
 		Client:     client,
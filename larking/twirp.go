@@ -0,0 +1,244 @@
+// Copyright 2024 Edward McFarlane. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package larking
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/protoadapt"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// Twirp error meta keys of status details.
+// https://twitchtv.github.io/twirp/docs/errors.html#metadata
+const (
+	twirpMetaReason     = "reason"      // ErrorInfo reason
+	twirpMetaDomain     = "domain"      // ErrorInfo domain
+	twirpMetaArgument   = "argument"    // BadRequest first field violation
+	twirpMetaViolation  = "violation."  // BadRequest field violation prefix
+	twirpMetaRetryAfter = "retry_after" // RetryInfo delay as a duration string
+)
+
+type twirpError struct {
+	Code    string            `json:"code"`
+	Message string            `json:"msg"`
+	Meta    map[string]string `json:"meta,omitempty"`
+}
+
+// TwirpErrorMetaOption sets the mapping of an error status and its trailers
+// to twirp error meta, choosing what is exposed to twirp clients. A nil
+// function, or nil result, omits meta. The default is DefaultTwirpErrorMeta.
+func TwirpErrorMetaOption(fn func(st *status.Status, trailer metadata.MD) map[string]string) MuxOption {
+	return func(opts *muxOptions) { opts.twirpErrorMeta = fn }
+}
+
+// TwirpErrorTrailersOption exposes the trailer keys as twirp error meta.
+// Trailers are not exposed by default. Keys set by the meta mapping take
+// precedence over trailers.
+func TwirpErrorTrailersOption(keys ...string) MuxOption {
+	return func(opts *muxOptions) {
+		for _, k := range keys {
+			opts.twirpErrorTrailers = append(opts.twirpErrorTrailers, strings.ToLower(k))
+		}
+	}
+}
+
+// DefaultTwirpErrorMeta maps the status details ErrorInfo, BadRequest and
+// RetryInfo to twirp error meta. ErrorInfo sets "reason", "domain" and its
+// metadata keys. BadRequest sets "argument" to the first field and
+// "violation.<field>" to each description. RetryInfo sets "retry_after" to
+// the delay. Trailers are ignored, see TwirpErrorTrailersOption.
+func DefaultTwirpErrorMeta(st *status.Status, _ metadata.MD) map[string]string {
+	meta := make(map[string]string)
+	for _, detail := range st.Details() {
+		switch d := detail.(type) {
+		case *errdetails.ErrorInfo:
+			for k, v := range d.Metadata {
+				meta[k] = v
+			}
+			if d.Reason != "" {
+				meta[twirpMetaReason] = d.Reason
+			}
+			if d.Domain != "" {
+				meta[twirpMetaDomain] = d.Domain
+			}
+		case *errdetails.BadRequest:
+			for i, v := range d.FieldViolations {
+				if i == 0 {
+					meta[twirpMetaArgument] = v.Field
+				}
+				meta[twirpMetaViolation+v.Field] = v.Description
+			}
+		case *errdetails.RetryInfo:
+			if d.RetryDelay != nil {
+				meta[twirpMetaRetryAfter] = d.RetryDelay.AsDuration().String()
+			}
+		}
+	}
+	if len(meta) == 0 {
+		return nil
+	}
+	return meta
+}
+
+// appendTwirpTrailers adds the allowed trailer keys to meta, keeping keys
+// already set.
+func appendTwirpTrailers(meta map[string]string, trailer metadata.MD, keys []string) map[string]string {
+	if len(trailer) == 0 || len(keys) == 0 {
+		return meta
+	}
+	hdr := make(http.Header, len(trailer))
+	setOutgoingHeader(hdr, trailer)
+	for _, k := range keys {
+		vs := hdr.Values(k)
+		if len(vs) == 0 {
+			continue
+		}
+		if _, ok := meta[k]; ok {
+			continue
+		}
+		if meta == nil {
+			meta = make(map[string]string)
+		}
+		meta[k] = strings.Join(vs, ", ")
+	}
+	return meta
+}
+
+// twirpCodeNames maps gRPC codes to twirp error codes.
+// https://twitchtv.github.io/twirp/docs/spec_v7.html#error-codes
+var twirpCodeNames = [...]string{
+	"",                    // 0
+	"canceled",            // 1
+	"unknown",             // 2
+	"invalid_argument",    // 3
+	"deadline_exceeded",   // 4
+	"not_found",           // 5
+	"already_exists",      // 6
+	"permission_denied",   // 7
+	"resource_exhausted",  // 8
+	"failed_precondition", // 9
+	"aborted",             // 10
+	"out_of_range",        // 11
+	"unimplemented",       // 12
+	"internal",            // 13
+	"unavailable",         // 14
+	"dataloss",            // 15
+	"unauthenticated",     // 16
+}
+
+// twirpCode returns the twirp error code string of the gRPC code.
+func twirpCode(c codes.Code) string {
+	if int(c) >= len(twirpCodeNames) || c == codes.OK {
+		return "unknown"
+	}
+	return twirpCodeNames[c]
+}
+
+// twirpCodes maps twirp error codes to gRPC codes, including the twirp only
+// codes.
+var twirpCodes = func() map[string]codes.Code {
+	m := map[string]codes.Code{
+		"malformed": codes.InvalidArgument,
+		"bad_route": codes.NotFound,
+	}
+	for c, name := range twirpCodeNames {
+		if name != "" {
+			m[name] = codes.Code(c)
+		}
+	}
+	return m
+}()
+
+// TwirpErrorStatus parses a twirp error response body as a status, the
+// reverse of DefaultTwirpErrorMeta. Use it in clients of twirp servers to
+// recover the status details. Meta keys without a detail mapping are kept as
+// ErrorInfo metadata.
+func TwirpErrorStatus(b []byte) (*status.Status, error) {
+	var terr twirpError
+	if err := json.Unmarshal(b, &terr); err != nil {
+		return nil, err
+	}
+	c, ok := twirpCodes[terr.Code]
+	if !ok {
+		c = codes.Unknown
+	}
+	st := status.New(c, terr.Message)
+	if len(terr.Meta) == 0 {
+		return st, nil
+	}
+
+	var (
+		info       errdetails.ErrorInfo
+		badRequest errdetails.BadRequest
+		retryInfo  *errdetails.RetryInfo
+	)
+	argument, hasArgument := terr.Meta[twirpMetaArgument]
+	if hasArgument {
+		badRequest.FieldViolations = append(badRequest.FieldViolations, &errdetails.BadRequest_FieldViolation{
+			Field:       argument,
+			Description: terr.Meta[twirpMetaViolation+argument],
+		})
+	}
+	keys := make([]string, 0, len(terr.Meta))
+	for k := range terr.Meta {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys) // stable field violation order
+	for _, k := range keys {
+		v := terr.Meta[k]
+		switch {
+		case k == twirpMetaReason:
+			info.Reason = v
+		case k == twirpMetaDomain:
+			info.Domain = v
+		case k == twirpMetaArgument:
+			continue // first field violation
+		case strings.HasPrefix(k, twirpMetaViolation):
+			field := strings.TrimPrefix(k, twirpMetaViolation)
+			if hasArgument && field == argument {
+				continue
+			}
+			badRequest.FieldViolations = append(badRequest.FieldViolations, &errdetails.BadRequest_FieldViolation{
+				Field:       field,
+				Description: v,
+			})
+		case k == twirpMetaRetryAfter:
+			if d, err := time.ParseDuration(v); err == nil {
+				retryInfo = &errdetails.RetryInfo{RetryDelay: durationpb.New(d)}
+				continue
+			}
+			fallthrough
+		default:
+			if info.Metadata == nil {
+				info.Metadata = make(map[string]string)
+			}
+			info.Metadata[k] = v
+		}
+	}
+
+	var details []protoadapt.MessageV1
+	if info.Reason != "" || info.Domain != "" || len(info.Metadata) > 0 {
+		details = append(details, &info)
+	}
+	if len(badRequest.FieldViolations) > 0 {
+		details = append(details, &badRequest)
+	}
+	if retryInfo != nil {
+		details = append(details, retryInfo)
+	}
+	if len(details) == 0 {
+		return st, nil
+	}
+	return st.WithDetails(details...)
+}
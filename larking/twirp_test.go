@@ -0,0 +1,168 @@
+// Copyright 2024 Edward McFarlane. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package larking
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	grpc_testing "google.golang.org/grpc/interop/grpc_testing"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/testing/protocmp"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+func TestTwirpError(t *testing.T) {
+	serve := func(t *testing.T, opts ...MuxOption) *twirpError {
+		t.Helper()
+		m, err := NewMux(opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		grpc_testing.RegisterTestServiceServer(m, &connectServer{})
+
+		body := `{"responseStatus":{"code":9,"message":"bad state"}}`
+		r := httptest.NewRequest(http.MethodPost, "/grpc.testing.TestService/UnaryCall", strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		r.Header.Set("Twirp-Version", "v7.1.0")
+		w := httptest.NewRecorder()
+		m.ServeHTTP(w, r)
+
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("got status %d: %s", w.Code, w.Body.String())
+		}
+		var terr twirpError
+		if err := json.Unmarshal(w.Body.Bytes(), &terr); err != nil {
+			t.Fatal(err)
+		}
+		if terr.Code != "failed_precondition" || terr.Message != "bad state" {
+			t.Fatalf("unexpected error %+v", terr)
+		}
+		return &terr
+	}
+
+	t.Run("meta", func(t *testing.T) {
+		terr := serve(t)
+		want := map[string]string{
+			"reason": "REASON",
+			"domain": "larking.io",
+		}
+		if diff := cmp.Diff(want, terr.Meta); diff != "" {
+			t.Fatal(diff)
+		}
+	})
+	t.Run("trailers", func(t *testing.T) {
+		terr := serve(t, TwirpErrorTrailersOption("X-Trailer", "reason", "x-missing"))
+		want := map[string]string{
+			"reason":    "REASON",
+			"domain":    "larking.io",
+			"x-trailer": "trailer",
+		}
+		if diff := cmp.Diff(want, terr.Meta); diff != "" {
+			t.Fatal(diff)
+		}
+	})
+	t.Run("option", func(t *testing.T) {
+		terr := serve(t, TwirpErrorMetaOption(func(st *status.Status, _ metadata.MD) map[string]string {
+			return map[string]string{"code": st.Code().String()}
+		}))
+		if diff := cmp.Diff(map[string]string{"code": "FailedPrecondition"}, terr.Meta); diff != "" {
+			t.Fatal(diff)
+		}
+	})
+	t.Run("none", func(t *testing.T) {
+		if terr := serve(t, TwirpErrorMetaOption(nil)); terr.Meta != nil {
+			t.Fatalf("unexpected meta %v", terr.Meta)
+		}
+	})
+}
+
+func TestTwirpErrorStatus(t *testing.T) {
+	st, err := status.New(codes.InvalidArgument, "invalid").WithDetails(
+		&errdetails.ErrorInfo{
+			Reason:   "REASON",
+			Domain:   "larking.io",
+			Metadata: map[string]string{"key": "value"},
+		},
+		&errdetails.BadRequest{
+			FieldViolations: []*errdetails.BadRequest_FieldViolation{
+				{Field: "name", Description: "required"},
+				{Field: "age", Description: "negative"},
+			},
+		},
+		&errdetails.RetryInfo{RetryDelay: durationpb.New(1500 * time.Millisecond)},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	meta := DefaultTwirpErrorMeta(st, nil)
+	wantMeta := map[string]string{
+		"reason":         "REASON",
+		"domain":         "larking.io",
+		"key":            "value",
+		"argument":       "name",
+		"violation.name": "required",
+		"violation.age":  "negative",
+		"retry_after":    "1.5s",
+	}
+	if diff := cmp.Diff(wantMeta, meta); diff != "" {
+		t.Fatal(diff)
+	}
+
+	b, err := json.Marshal(&twirpError{
+		Code:    twirpCode(st.Code()),
+		Message: st.Message(),
+		Meta:    meta,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := TwirpErrorStatus(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(st.Proto(), got.Proto(), protocmp.Transform()); diff != "" {
+		t.Fatal(diff)
+	}
+
+	got, err = TwirpErrorStatus([]byte(`{"code":"malformed","msg":"bad json"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Code() != codes.InvalidArgument || len(got.Details()) != 0 {
+		t.Fatalf("unexpected status %v", got)
+	}
+}
+
+func TestTwirpCodes(t *testing.T) {
+	for c := codes.Canceled; c <= codes.Unauthenticated; c++ {
+		b, err := json.Marshal(&twirpError{Code: twirpCode(c), Message: c.String()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		st, err := TwirpErrorStatus(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if st.Code() != c {
+			t.Errorf("%v: got code %v from %q", c, st.Code(), twirpCode(c))
+		}
+	}
+	if got := twirpCode(codes.Canceled); got != "canceled" {
+		t.Errorf("got canceled code %q", got)
+	}
+	if got := twirpCode(codes.DataLoss); got != "dataloss" {
+		t.Errorf("got data loss code %q", got)
+	}
+}
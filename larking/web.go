@@ -9,13 +9,22 @@ package larking
 // https://github.com/grpc/grpc/blob/master/doc/PROTOCOL-HTTP2.md
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/base64"
 	"encoding/binary"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"net/textproto"
 	"strings"
+	"sync"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 const (
@@ -145,17 +154,16 @@ type readCloser struct {
 }
 
 func (m *Mux) serveGRPCWeb(w http.ResponseWriter, r *http.Request) {
+	if isWebsocketRequest(r) {
+		m.serveGRPCWebsocket(w, r)
+		return
+	}
 	typ, enc, ok := isWebRequest(r)
 	if !ok {
 		msg := fmt.Sprintf("invalid gRPC-Web content type: %v", r.Header.Get("Content-Type"))
 		http.Error(w, msg, http.StatusBadRequest)
 		return
 	}
-	// TODO: Check for websocket request and upgrade.
-	if strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
-		http.Error(w, "unimplemented websocket support", http.StatusInternalServerError)
-		return
-	}
 
 	r.ProtoMajor = 2
 	r.ProtoMinor = 0
@@ -173,3 +181,177 @@ func (m *Mux) serveGRPCWeb(w http.ResponseWriter, r *http.Request) {
 	m.serveGRPC(ww, r)
 	ww.flushWithTrailer()
 }
+
+// grpcWebsockets is the subprotocol of gRPC-web over websockets.
+// https://github.com/improbable-eng/grpc-web/blob/master/go/grpcweb/websocket_wrapper.go
+const grpcWebsockets = "grpc-websockets"
+
+// isWebsocketWebRequest checks for a gRPC-web websocket upgrade.
+func isWebsocketWebRequest(r *http.Request) bool {
+	if !isWebsocketRequest(r) {
+		return false
+	}
+	for _, v := range r.Header.Values("Sec-Websocket-Protocol") {
+		for _, p := range strings.Split(v, ",") {
+			if strings.TrimSpace(p) == grpcWebsockets {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// websocketWebWriter writes gRPC-web responses as websocket binary messages.
+// Headers are sent as the first message in HTTP/1 format.
+type websocketWebWriter struct {
+	mu          sync.Mutex
+	conn        net.Conn
+	header      http.Header
+	wroteHeader bool
+}
+
+func (w *websocketWebWriter) Header() http.Header { return w.header }
+
+func (w *websocketWebWriter) writeHeader() error {
+	if w.wroteHeader {
+		return nil
+	}
+	w.wroteHeader = true
+
+	var buf bytes.Buffer
+	for key, vals := range w.header {
+		for _, val := range vals {
+			fmt.Fprintf(&buf, "%s: %s\r\n", strings.ToLower(key), val)
+		}
+	}
+	return wsutil.WriteServerBinary(w.conn, buf.Bytes())
+}
+
+func (w *websocketWebWriter) WriteHeader(code int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.writeHeader() //nolint
+}
+
+func (w *websocketWebWriter) Write(b []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.writeHeader(); err != nil {
+		return 0, err
+	}
+	if err := wsutil.WriteServerBinary(w.conn, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (w *websocketWebWriter) Flush() {}
+
+// websocketWebReader reads the client stream of gRPC-web websocket
+// messages. Each message is prefixed by a byte: 0 for data, 1 for the end
+// of the client stream.
+type websocketWebReader struct {
+	conn  net.Conn
+	limit int // max message size, excluding the frame prefixes
+	buf   []byte
+	eof   bool
+	err   error // message too large
+}
+
+func (r *websocketWebReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.eof {
+			return 0, io.EOF
+		}
+		// Frame type and gRPC message prefix.
+		b, err := readWebsocketData(r.conn, r.limit+6)
+		if err != nil {
+			if status.Code(err) == codes.ResourceExhausted {
+				r.err = err
+			}
+			return 0, err
+		}
+		if len(b) == 0 {
+			continue
+		}
+		switch b[0] {
+		case 0:
+			r.buf = b[1:]
+		case 1:
+			r.eof = true
+		default:
+			return 0, fmt.Errorf("invalid gRPC-web websocket frame type %d", b[0])
+		}
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func (r *websocketWebReader) Close() error { return nil }
+
+// serveGRPCWebsocket serves gRPC-web over websockets, supporting client and
+// bidi streaming in browsers. The first client message has the request
+// headers.
+func (m *Mux) serveGRPCWebsocket(w http.ResponseWriter, r *http.Request) {
+	upgrader := ws.HTTPUpgrader{
+		Protocol: func(p string) bool { return p == grpcWebsockets },
+	}
+	conn, _, _, err := upgrader.Upgrade(r, w)
+	if err != nil {
+		return // response written by upgrader
+	}
+	defer conn.Close()
+
+	b, err := readWebsocketData(conn, m.opts.maxReceiveMessageSize)
+	if err != nil {
+		if status.Code(err) == codes.ResourceExhausted {
+			writeMessageTooBig(conn, "gRPC-web headers too large")
+		}
+		return
+	}
+	tr := textproto.NewReader(bufio.NewReader(
+		io.MultiReader(bytes.NewReader(b), strings.NewReader("\r\n")),
+	))
+	mimeHdr, err := tr.ReadMIMEHeader()
+	if err != nil {
+		f := ws.NewCloseFrame(ws.NewCloseFrameBody(
+			ws.StatusProtocolError, "invalid gRPC-web headers",
+		))
+		conn.Write(ws.MustCompileFrame(f)) //nolint
+		return
+	}
+	hdr := http.Header(mimeHdr)
+
+	enc := "proto"
+	if _, e, ok := strings.Cut(hdr.Get("Content-Type"), "+"); ok {
+		enc = e
+	}
+
+	r = r.Clone(r.Context())
+	r.Method = http.MethodPost
+	r.ProtoMajor = 2
+	r.ProtoMinor = 0
+	r.Header = hdr
+	r.Header.Set("Content-Type", grpcBase+"+"+enc)
+	body := &websocketWebReader{conn: conn, limit: m.opts.maxReceiveMessageSize}
+	r.Body = body
+
+	ww := newWebWriter(&websocketWebWriter{
+		conn:   conn,
+		header: make(http.Header),
+	}, grpcWeb, enc)
+	m.serveGRPC(ww, r)
+	ww.flushWithTrailer()
+	if body.err != nil {
+		writeMessageTooBig(conn, "gRPC-web message too large")
+		return
+	}
+	conn.Write(ws.CompiledClose) //nolint
+}
+
+// writeMessageTooBig closes the websocket for a message over the limit.
+func writeMessageTooBig(conn net.Conn, reason string) {
+	f := ws.NewCloseFrame(ws.NewCloseFrameBody(ws.StatusMessageTooBig, reason))
+	conn.Write(ws.MustCompileFrame(f)) //nolint
+}
@@ -6,14 +6,22 @@ package larking
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
+	"errors"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
 	"github.com/google/go-cmp/cmp"
 	"google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/protobuf/encoding/protojson"
 	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/testing/protocmp"
@@ -143,3 +151,179 @@ func TestWeb(t *testing.T) {
 		})
 	}
 }
+
+type echoChatServer struct {
+	testpb.UnimplementedChatRoomServer
+}
+
+func (echoChatServer) Chat(stream testpb.ChatRoom_ChatServer) error {
+	if err := stream.SendHeader(metadata.Pairs("room", "echo")); err != nil {
+		return err
+	}
+	for {
+		msg, err := stream.Recv()
+		if err == io.EOF {
+			stream.SetTrailer(metadata.Pairs("count", "done"))
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := stream.Send(&testpb.ChatMessage{Text: "echo: " + msg.Text}); err != nil {
+			return err
+		}
+	}
+}
+
+func TestWebsocketWeb(t *testing.T) {
+	m, err := NewMux()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.RegisterService(&testpb.ChatRoom_ServiceDesc, echoChatServer{})
+
+	srv := httptest.NewServer(m)
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(testContext(t), time.Minute)
+	defer cancel()
+
+	urlStr := "ws" + strings.TrimPrefix(srv.URL, "http") + "/larking.testpb.ChatRoom/Chat"
+	conn, _, hs, err := ws.Dialer{
+		Protocols: []string{grpcWebsockets},
+	}.Dial(ctx, urlStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if hs.Protocol != grpcWebsockets {
+		t.Fatalf("got protocol %q", hs.Protocol)
+	}
+
+	frame := func(b []byte, msb uint8) []byte {
+		head := append([]byte{0 | msb, 0, 0, 0, 0}, b...)
+		binary.BigEndian.PutUint32(head[1:5], uint32(len(b)))
+		return head
+	}
+	write := func(b []byte) {
+		t.Helper()
+		if err := wsutil.WriteClientBinary(conn, b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	read := func() []byte {
+		t.Helper()
+		b, _, err := wsutil.ReadServerData(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+
+	// Headers, then each message.
+	write([]byte("content-type: application/grpc-web+proto\r\nx-grpc-web: 1\r\n"))
+	for _, text := range []string{"hello", "world"} {
+		b, err := proto.Marshal(&testpb.ChatMessage{Text: text})
+		if err != nil {
+			t.Fatal(err)
+		}
+		write(append([]byte{0}, frame(b, 0)...))
+	}
+	write([]byte{1}) // end of client stream
+
+	if hdr := string(read()); !strings.Contains(hdr, "room: echo\r\n") {
+		t.Fatalf("missing header in %q", hdr)
+	}
+	for _, want := range []string{"echo: hello", "echo: world"} {
+		b := read()
+		if len(b) < 5 || b[0] != 0 {
+			t.Fatalf("invalid message frame %X", b)
+		}
+		msg := &testpb.ChatMessage{}
+		if err := proto.Unmarshal(b[5:], msg); err != nil {
+			t.Fatal(err)
+		}
+		if msg.Text != want {
+			t.Fatalf("got %q, want %q", msg.Text, want)
+		}
+	}
+
+	// Trailer frame.
+	var trailer []byte
+	for len(trailer) == 0 || trailer[0]&(1<<7) == 0 || len(trailer) < 5+int(binary.BigEndian.Uint32(trailer[1:5])) {
+		trailer = append(trailer, read()...)
+	}
+	tr := string(trailer[5:])
+	for _, want := range []string{"grpc-status: 0\r\n", "count: done\r\n"} {
+		if !strings.Contains(tr, want) {
+			t.Errorf("missing %q in trailer %q", want, tr)
+		}
+	}
+}
+
+func TestWebsocketWebMessageTooBig(t *testing.T) {
+	m, err := NewMux(MaxReceiveMessageSizeOption(64))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.RegisterService(&testpb.ChatRoom_ServiceDesc, echoChatServer{})
+
+	srv := httptest.NewServer(m)
+	defer srv.Close()
+
+	urlStr := "ws" + strings.TrimPrefix(srv.URL, "http") + "/larking.testpb.ChatRoom/Chat"
+	dial := func(t *testing.T) net.Conn {
+		t.Helper()
+		conn, _, _, err := ws.Dialer{
+			Protocols: []string{grpcWebsockets},
+		}.Dial(testContext(t), urlStr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+
+	t.Run("headers", func(t *testing.T) {
+		conn := dial(t)
+		defer conn.Close()
+
+		hdr := "content-type: application/grpc-web+proto\r\nx-large: " + strings.Repeat("a", 128) + "\r\n"
+		if err := wsutil.WriteClientBinary(conn, []byte(hdr)); err != nil {
+			t.Fatal(err)
+		}
+		_, _, err := wsutil.ReadServerData(conn)
+		var closed wsutil.ClosedError
+		if !errors.As(err, &closed) || closed.Code != ws.StatusMessageTooBig {
+			t.Fatalf("got %v, want message too big", err)
+		}
+	})
+	t.Run("message", func(t *testing.T) {
+		conn := dial(t)
+		defer conn.Close()
+
+		if err := wsutil.WriteClientBinary(conn, []byte("content-type: application/grpc-web+proto\r\n")); err != nil {
+			t.Fatal(err)
+		}
+		b, err := proto.Marshal(&testpb.ChatMessage{Text: strings.Repeat("a", 128)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		head := []byte{0, 0, 0, 0, 0, 0}
+		binary.BigEndian.PutUint32(head[2:6], uint32(len(b)))
+		if err := wsutil.WriteClientBinary(conn, append(head, b...)); err != nil {
+			t.Fatal(err)
+		}
+
+		for {
+			_, _, err := wsutil.ReadServerData(conn)
+			if err == nil {
+				continue
+			}
+			var closed wsutil.ClosedError
+			if !errors.As(err, &closed) || closed.Code != ws.StatusMessageTooBig {
+				t.Fatalf("got %v, want message too big", err)
+			}
+			return
+		}
+	})
+}
@@ -1,23 +1,48 @@
 package larking
 
 import (
+	"bytes"
 	"context"
+	"io"
 	"net"
+	"net/http"
 
 	"github.com/gobwas/ws"
 	"github.com/gobwas/ws/wsutil"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/metadata"
-	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/proto"
 )
 
 const kindWebsocket = "WEBSOCKET"
 
+// websocketCodec returns the codec negotiated by the websocket subprotocol,
+// matched on the codec name. Content codecs aren't message codecs.
+func (o *muxOptions) websocketCodec(protocol string) (Codec, bool) {
+	c, ok := o.codecsByName[protocol]
+	if !ok {
+		return nil, false
+	}
+	switch c.(type) {
+	case codecHTTPBody, CodecEventStream:
+		return nil, false
+	}
+	return c, true
+}
+
+// streamWS streams messages over a websocket. Without a subprotocol messages
+// are protobuf JSON text frames. With a negotiated codec subprotocol, messages
+// are binary frames, the first text frame has the response headers and the
+// last text frame, before close, has the trailers. Both are in HTTP/1 format.
 type streamWS struct {
 	ctx        context.Context
 	conn       net.Conn
 	method     *method
+	opts       *muxOptions
+	codec      Codec
+	protocol   string
 	header     metadata.MD
 	trailer    metadata.MD
 	params     params
@@ -37,16 +62,41 @@ func (s *streamWS) SendHeader(md metadata.MD) error {
 	if s.sentHeader {
 		return nil // already sent?
 	}
-	// TODO: headers?
+	s.header = metadata.Join(s.header, md)
 	s.sentHeader = true
-	return nil
+	if s.protocol == "" {
+		return nil // no metadata frames
+	}
+	return s.writeMetadata(s.header)
 }
 
 func (s *streamWS) SetTrailer(md metadata.MD) {
-	s.sentHeader = true
 	s.trailer = metadata.Join(s.trailer, md)
 }
 
+// writeMetadata writes the metadata as a text frame of HTTP/1 headers.
+func (s *streamWS) writeMetadata(md metadata.MD) error {
+	hdr := make(http.Header, len(md))
+	setOutgoingHeader(hdr, md)
+
+	var buf bytes.Buffer
+	if err := hdr.Write(&buf); err != nil {
+		return err
+	}
+	return wsutil.WriteServerText(s.conn, buf.Bytes())
+}
+
+// finish sends the headers, if unsent, and trailers of negotiated streams.
+func (s *streamWS) finish() error {
+	if s.protocol == "" {
+		return nil
+	}
+	if err := s.SendHeader(nil); err != nil {
+		return err
+	}
+	return s.writeMetadata(s.trailer)
+}
+
 func (s *streamWS) Context() context.Context {
 	sts := &serverTransportStream{s, s.method.name}
 	return grpc.NewContextWithServerTransportStream(s.ctx, sts)
@@ -55,24 +105,67 @@ func (s *streamWS) Context() context.Context {
 func (s *streamWS) SendMsg(v interface{}) error {
 	s.sendN += 1
 	reply := v.(proto.Message)
-	//ctx := s.ctx
 
-	cur := reply.ProtoReflect()
-	for _, fd := range s.method.resp {
-		cur = cur.Mutable(fd).Message()
-	}
-	msg := cur.Interface()
+	cur, fd := s.method.responseBody(reply.ProtoReflect())
 
-	// TODO: contentType check?
-	b, err := protojson.Marshal(msg)
+	var (
+		b   []byte
+		err error
+	)
+	if fd != nil {
+		b, err = marshalFieldAppend(s.codec, b, cur, fd)
+	} else {
+		b, err = s.codec.MarshalAppend(b, cur.Interface())
+	}
 	if err != nil {
-		return err
+		return status.Errorf(codes.Internal, "%s: error while marshaling: %v", s.codec.Name(), err)
+	}
+	if len(b) > s.opts.maxSendMessageSize {
+		return status.Errorf(codes.ResourceExhausted, "websocket: sent message larger than max (%d vs. %d)", len(b), s.opts.maxSendMessageSize)
 	}
 
-	if err := wsutil.WriteServerMessage(s.conn, ws.OpText, b); err != nil {
+	if err := s.SendHeader(nil); err != nil {
 		return err
 	}
-	return nil
+	op := ws.OpText
+	if s.protocol != "" {
+		op = ws.OpBinary
+	}
+	return wsutil.WriteServerMessage(s.conn, op, b)
+}
+
+// readWebsocketData reads the next client message up to limit bytes.
+func readWebsocketData(conn net.Conn, limit int) ([]byte, error) {
+	controlHandler := wsutil.ControlFrameHandler(conn, ws.StateServerSide)
+	rd := wsutil.Reader{
+		Source:         conn,
+		State:          ws.StateServerSide,
+		CheckUTF8:      true,
+		OnIntermediate: controlHandler,
+	}
+	for {
+		hdr, err := rd.NextFrame()
+		if err != nil {
+			return nil, err
+		}
+		if hdr.OpCode.IsControl() {
+			if err := controlHandler(hdr, &rd); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		b, err := io.ReadAll(io.LimitReader(&rd, int64(limit)+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(b) > limit {
+			if err := rd.Discard(); err != nil {
+				return nil, err
+			}
+			return nil, status.Errorf(codes.ResourceExhausted, "websocket: received message larger than max (%d vs. %d)", len(b), limit)
+		}
+		return b, nil
+	}
 }
 
 func (s *streamWS) RecvMsg(m interface{}) error {
@@ -87,15 +180,13 @@ func (s *streamWS) RecvMsg(m interface{}) error {
 
 		msg := cur.Interface()
 
-		b, _, err := wsutil.ReadClientData(s.conn)
+		b, err := readWebsocketData(s.conn, s.opts.maxReceiveMessageSize)
 		if err != nil {
 			return err
 		}
 
-		// TODO: contentType check?
-		// What marshalling options should we support?
-		if err := protojson.Unmarshal(b, msg); err != nil {
-			return err
+		if err := s.codec.Unmarshal(b, msg); err != nil {
+			return status.Errorf(codes.Internal, "%s: error while unmarshaling: %v", s.codec.Name(), err)
 		}
 	}
 
@@ -1,11 +1,16 @@
 package larking
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"errors"
 	"io"
 	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"strings"
 	"testing"
 	"time"
 
@@ -14,6 +19,9 @@ import (
 	"github.com/google/go-cmp/cmp"
 	"golang.org/x/sync/errgroup"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/encoding/protojson"
 	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/testing/protocmp"
@@ -172,3 +180,207 @@ func TestWebsocket(t *testing.T) {
 		})
 	}
 }
+
+type chatRoomServer struct {
+	testpb.UnimplementedChatRoomServer
+}
+
+func (chatRoomServer) Chat(stream testpb.ChatRoom_ChatServer) error {
+	if err := stream.SetHeader(metadata.Pairs("x-header", "header")); err != nil {
+		return err
+	}
+	stream.SetTrailer(metadata.Pairs("x-trailer", "trailer"))
+	for {
+		msg, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		if msg.Text == "bye" {
+			return nil
+		}
+		if err := stream.Send(&testpb.ChatMessage{
+			Name: msg.Name,
+			Text: "echo: " + msg.Text,
+		}); err != nil {
+			return err
+		}
+	}
+}
+
+func TestWebsocketProtocol(t *testing.T) {
+	mux, err := NewMux(MaxReceiveMessageSizeOption(64))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux.RegisterService(&testpb.ChatRoom_ServiceDesc, chatRoomServer{})
+
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+	urlStr := "ws" + strings.TrimPrefix(ts.URL, "http") + "/v1/rooms/chat"
+
+	dial := func(t *testing.T, protocol string) net.Conn {
+		t.Helper()
+		conn, _, hs, err := ws.Dialer{
+			Protocols: []string{protocol},
+		}.Dial(testContext(t), urlStr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hs.Protocol != protocol {
+			t.Fatalf("got protocol %q, want %q", hs.Protocol, protocol)
+		}
+		return conn
+	}
+	readMetadata := func(t *testing.T, conn net.Conn, key, want string) {
+		t.Helper()
+		b, op, err := wsutil.ReadServerData(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if op != ws.OpText {
+			t.Fatalf("got op %v, want text", op)
+		}
+		hdr, err := textproto.NewReader(bufio.NewReader(
+			io.MultiReader(bytes.NewReader(b), strings.NewReader("\r\n")),
+		)).ReadMIMEHeader()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := hdr.Get(key); got != want {
+			t.Fatalf("got %s %q, want %q", key, got, want)
+		}
+	}
+
+	t.Run("proto", func(t *testing.T) {
+		conn := dial(t, "proto")
+		defer conn.Close()
+
+		b, err := proto.Marshal(&testpb.ChatMessage{Text: "hello"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := wsutil.WriteClientBinary(conn, b); err != nil {
+			t.Fatal(err)
+		}
+		readMetadata(t, conn, "x-header", "header")
+
+		b, op, err := wsutil.ReadServerData(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if op != ws.OpBinary {
+			t.Fatalf("got op %v, want binary", op)
+		}
+		got := &testpb.ChatMessage{}
+		if err := proto.Unmarshal(b, got); err != nil {
+			t.Fatal(err)
+		}
+		want := &testpb.ChatMessage{Name: "rooms/chat", Text: "echo: hello"}
+		if diff := cmp.Diff(want, got, protocmp.Transform()); diff != "" {
+			t.Fatal(diff)
+		}
+
+		b, err = proto.Marshal(&testpb.ChatMessage{Text: "bye"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := wsutil.WriteClientBinary(conn, b); err != nil {
+			t.Fatal(err)
+		}
+		readMetadata(t, conn, "x-trailer", "trailer")
+
+		_, _, err = wsutil.ReadServerData(conn)
+		var closed wsutil.ClosedError
+		if !errors.As(err, &closed) || closed.Code != ws.StatusNoStatusRcvd {
+			t.Fatalf("got %v, want closure", err)
+		}
+	})
+	t.Run("json", func(t *testing.T) {
+		conn := dial(t, "json")
+		defer conn.Close()
+
+		if err := wsutil.WriteClientBinary(conn, []byte(`{"text":"hello"}`)); err != nil {
+			t.Fatal(err)
+		}
+		readMetadata(t, conn, "x-header", "header")
+
+		b, op, err := wsutil.ReadServerData(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if op != ws.OpBinary {
+			t.Fatalf("got op %v, want binary", op)
+		}
+		got := &testpb.ChatMessage{}
+		if err := protojson.Unmarshal(b, got); err != nil {
+			t.Fatal(err)
+		}
+		if got.Text != "echo: hello" {
+			t.Fatalf("got text %q", got.Text)
+		}
+	})
+	t.Run("maxReceiveMessageSize", func(t *testing.T) {
+		conn := dial(t, "proto")
+		defer conn.Close()
+
+		b, err := proto.Marshal(&testpb.ChatMessage{Text: strings.Repeat("a", 128)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := wsutil.WriteClientBinary(conn, b); err != nil {
+			t.Fatal(err)
+		}
+		readMetadata(t, conn, "x-header", "header")
+		readMetadata(t, conn, "x-trailer", "trailer")
+
+		_, _, err = wsutil.ReadServerData(conn)
+		var closed wsutil.ClosedError
+		if !errors.As(err, &closed) || closed.Code != WSStatusCode(codes.ResourceExhausted) {
+			t.Fatalf("got %v, want resource exhausted", err)
+		}
+	})
+}
+
+type messageTooBigStatusMapper struct{ DefaultStatusMapper }
+
+func (m messageTooBigStatusMapper) WSStatusCode(method string, st *status.Status) ws.StatusCode {
+	if method == "/larking.testpb.ChatRoom/Chat" && st.Code() == codes.ResourceExhausted {
+		return ws.StatusMessageTooBig
+	}
+	return m.DefaultStatusMapper.WSStatusCode(method, st)
+}
+
+func TestWebsocketStatusMapper(t *testing.T) {
+	mux, err := NewMux(
+		MaxReceiveMessageSizeOption(64),
+		StatusMapperOption(messageTooBigStatusMapper{}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux.RegisterService(&testpb.ChatRoom_ServiceDesc, chatRoomServer{})
+
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	conn, _, _, err := ws.Dial(testContext(t), "ws"+strings.TrimPrefix(ts.URL, "http")+"/v1/rooms/chat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if err := wsutil.WriteClientText(conn, []byte(`{"text":"`+strings.Repeat("a", 128)+`"}`)); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		_, _, err := wsutil.ReadServerData(conn)
+		if err == nil {
+			continue
+		}
+		var closed wsutil.ClosedError
+		if !errors.As(err, &closed) || closed.Code != ws.StatusMessageTooBig {
+			t.Fatalf("got %v, want message too big", err)
+		}
+		return
+	}
+}